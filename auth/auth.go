@@ -8,6 +8,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -43,7 +45,7 @@ func (a Auth) Sign(val string) string {
 // that is the case. If Timeout is not zero then this will ensure the signature
 // has not timed out as well.
 func (a Auth) Verify(sig, val string) bool {
-	p := strings.SplitN(sig, "_", 2)
+	p := strings.SplitN(sig, sep, 2)
 	if len(p) != 2 {
 		return false
 	}
@@ -60,14 +62,44 @@ func (a Auth) Verify(sig, val string) bool {
 		return true
 	}
 
-	tf, err := strconv.ParseFloat(tStr, 64)
+	t, err := SigTime(sig)
 	if err != nil {
 		return false
 	}
-
-	t := timeutil.TimestampFromFloat64(tf)
-	if time.Since(t.Time) > a.Timeout {
+	if time.Since(t) > a.Timeout {
 		return false
 	}
 	return true
 }
+
+// SigHeader is the http header which otter sends the signature of a request's
+// body in, when making requests to a backend application, e.g. webhook
+// deliveries and authorization checks
+const SigHeader = "X-Otter-Signature"
+
+// SignRequest sets SigHeader on the request to a signature of the given body,
+// which should be what the request is going to send
+func (a Auth) SignRequest(r *http.Request, body []byte) {
+	r.Header.Set(SigHeader, a.Sign(string(body)))
+}
+
+// VerifyRequest returns whether the request's SigHeader is a valid signature of
+// the given body, which should be what was read from the request
+func (a Auth) VerifyRequest(r *http.Request, body []byte) bool {
+	return a.Verify(r.Header.Get(SigHeader), string(body))
+}
+
+// SigTime returns the time the given signature was created at. It does not
+// verify the signature in any way.
+func SigTime(sig string) (time.Time, error) {
+	p := strings.SplitN(sig, sep, 2)
+	if len(p) != 2 {
+		return time.Time{}, errors.New("malformed signature")
+	}
+
+	tf, err := strconv.ParseFloat(p[1], 64)
+	if err != nil {
+		return time.Time{}, errors.New("malformed signature timestamp")
+	}
+	return timeutil.TimestampFromFloat64(tf).Time, nil
+}
@@ -1,11 +1,13 @@
 package auth
 
 import (
+	"net/http"
 	. "testing"
 	"time"
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAuth(t *T) {
@@ -27,3 +29,35 @@ func TestAuth(t *T) {
 	a.Timeout = 1 * time.Second
 	assert.True(t, a.Verify(sig, val))
 }
+
+func TestSigTime(t *T) {
+	a := Auth{
+		Key: testutil.RandStr(),
+	}
+
+	before := time.Now()
+	sig := a.Sign(testutil.RandStr())
+	st, err := SigTime(sig)
+	require.Nil(t, err)
+	assert.WithinDuration(t, before, st, 10*time.Millisecond)
+
+	_, err = SigTime("foo")
+	assert.NotNil(t, err)
+	_, err = SigTime("foo_bar")
+	assert.NotNil(t, err)
+}
+
+func TestSignRequest(t *T) {
+	a := Auth{
+		Key: testutil.RandStr(),
+	}
+	body := []byte(testutil.RandStr())
+
+	r, err := http.NewRequest("POST", "http://localhost", nil)
+	require.Nil(t, err)
+	a.SignRequest(r, body)
+	assert.NotEmpty(t, r.Header.Get(SigHeader))
+	assert.True(t, a.VerifyRequest(r, body))
+	assert.False(t, a.VerifyRequest(r, []byte(testutil.RandStr())))
+	assert.False(t, (Auth{Key: testutil.RandStr()}).VerifyRequest(r, body))
+}
@@ -0,0 +1,211 @@
+// Package authz asks a backend application, over http, whether connections are
+// allowed to subscribe or publish to channels. This allows for rules which
+// can't be expressed with presence signatures alone, e.g. "this user may only
+// subscribe to this room if they are currently a member of it".
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/conn"
+)
+
+// Actions which may be authorized
+const (
+	ActionSub = "sub"
+	ActionPub = "pub"
+)
+
+// Opts describes where and how to make authorization requests
+type Opts struct {
+	// URL which is POSTed a json encoded Request for each authorization. A 2xx
+	// response allows the action and a 401 or 403 denies it. Any other
+	// response is considered an error, see FailOpen.
+	URL string
+
+	// Used to sign each request's body, which can be checked with auth.Auth's
+	// VerifyRequest
+	Secret string
+
+	// Timeout for each request. Defaults to 2s.
+	Timeout time.Duration
+
+	// How long an allow or deny for a given action, presence and channel is
+	// remembered, so the same request isn't made repeatedly. If zero nothing
+	// is remembered.
+	CacheTTL time.Duration
+
+	// If set, actions are allowed if the request fails, rather than being
+	// refused
+	FailOpen bool
+}
+
+// Request is the body of each request made to Opts.URL. Conn's ID is given
+// for informational purposes only, results are cached based on its presence.
+type Request struct {
+	Action  string    `json:"action"`
+	Conn    conn.Conn `json:"connection"`
+	Channel string    `json:"channel"`
+}
+
+type cacheEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+type authorizer struct {
+	o      Opts
+	client *http.Client
+
+	l     sync.Mutex
+	cache map[string]cacheEntry
+}
+
+var a *authorizer
+
+// Init causes Authorize to start making requests to the URL in the given Opts.
+// Until it's called Authorize allows everything.
+func Init(o Opts) {
+	a = newAuthorizer(o)
+	if o.CacheTTL > 0 {
+		go func() {
+			for range time.Tick(o.CacheTTL) {
+				a.clean()
+			}
+		}()
+	}
+	llog.Info("authorizing subs and pubs", llog.KV{"url": o.URL})
+}
+
+func newAuthorizer(o Opts) *authorizer {
+	if o.Timeout == 0 {
+		o.Timeout = 2 * time.Second
+	}
+	return &authorizer{
+		o:      o,
+		client: &http.Client{Timeout: o.Timeout},
+		cache:  map[string]cacheEntry{},
+	}
+}
+
+// Authorize returns whether the given Conn may perform the given action on the
+// given channel. Backend connections are always allowed. An error is only
+// returned if the request failed and Opts.FailOpen isn't set.
+//
+// Subscribes are authorized when a connection is made, and again with the new
+// presence whenever the connection's presence is updated, but not otherwise.
+func Authorize(action string, c conn.Conn, channel string) (bool, error) {
+	if a == nil {
+		return true, nil
+	}
+	return a.authorize(action, c, channel)
+}
+
+func (a *authorizer) authorize(action string, c conn.Conn, channel string) (bool, error) {
+	if c.IsBackend {
+		return true, nil
+	}
+
+	b, err := json.Marshal(Request{
+		Action:  action,
+		Conn:    c,
+		Channel: channel,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// the key is made of json strings so that no combination of action,
+	// presence and channel can be mistaken for another
+	key := string(mustMarshal(action)) + string(mustMarshal(c.PresenceKey())) + string(mustMarshal(channel))
+	if allowed, ok := a.cached(key); ok {
+		return allowed, nil
+	}
+
+	allowed, err := a.request(b)
+	if err != nil {
+		kv := llog.KV{
+			"url":     a.o.URL,
+			"action":  action,
+			"channel": channel,
+			"err":     err,
+		}
+		if a.o.FailOpen {
+			llog.Warn("authorization request failed, allowing", kv)
+			return true, nil
+		}
+		llog.Error("authorization request failed", kv)
+		return false, err
+	}
+
+	if a.o.CacheTTL > 0 {
+		a.l.Lock()
+		a.cache[key] = cacheEntry{
+			allowed: allowed,
+			expires: time.Now().Add(a.o.CacheTTL),
+		}
+		a.l.Unlock()
+	}
+	return allowed, nil
+}
+
+func mustMarshal(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+func (a *authorizer) cached(key string) (bool, bool) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	e, ok := a.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return false, false
+	}
+	return e.allowed, true
+}
+
+// clean removes all expired entries from the cache
+func (a *authorizer) clean() {
+	now := time.Now()
+	a.l.Lock()
+	defer a.l.Unlock()
+	for k, e := range a.cache {
+		if now.After(e.expires) {
+			delete(a.cache, k)
+		}
+	}
+}
+
+func (a *authorizer) request(b []byte) (bool, error) {
+	r, err := http.NewRequest("POST", a.o.URL, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	(auth.Auth{Key: a.o.Secret}).SignRequest(r, b)
+
+	resp, err := a.client.Do(r)
+	if err != nil {
+		return false, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, errors.New("authorization endpoint responded " + http.StatusText(resp.StatusCode))
+	}
+}
@@ -0,0 +1,152 @@
+package authz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/conn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	conn.NodeID = testutil.RandStr()
+}
+
+// newBackend starts an authorization endpoint which checks the signature of
+// each request it's sent, and responds with whatever code fn returns for it
+func newBackend(t *testing.T, secret string, fn func(Request) int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		assert.True(t, (auth.Auth{Key: secret}).VerifyRequest(r, body))
+
+		var req Request
+		require.Nil(t, json.Unmarshal(body, &req))
+		w.WriteHeader(fn(req))
+	}))
+}
+
+func TestAuthorize(t *testing.T) {
+	secret := testutil.RandStr()
+	reqCh := make(chan Request, 10)
+	srv := newBackend(t, secret, func(req Request) int {
+		reqCh <- req
+		if req.Action == ActionPub {
+			return http.StatusOK
+		}
+		return http.StatusForbidden
+	})
+	defer srv.Close()
+	a := newAuthorizer(Opts{URL: srv.URL, Secret: secret})
+
+	c := conn.New()
+	require.Nil(t, c.SetPresence(`{"user":123}`))
+	ch := testutil.RandStr()
+
+	ok, err := a.authorize(ActionSub, c, ch)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, Request{Action: ActionSub, Conn: c, Channel: ch}, <-reqCh)
+
+	ok, err = a.authorize(ActionPub, c, ch)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Request{Action: ActionPub, Conn: c, Channel: ch}, <-reqCh)
+
+	// backends don't need to be authorized
+	backend := conn.New()
+	backend.IsBackend = true
+	ok, err = a.authorize(ActionSub, backend, testutil.RandStr())
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Len(t, reqCh, 0)
+}
+
+func TestAuthorizeCache(t *testing.T) {
+	secret := testutil.RandStr()
+	var deny int32
+	reqCh := make(chan Request, 10)
+	srv := newBackend(t, secret, func(req Request) int {
+		reqCh <- req
+		if atomic.LoadInt32(&deny) == 1 {
+			return http.StatusForbidden
+		}
+		return http.StatusOK
+	})
+	defer srv.Close()
+	a := newAuthorizer(Opts{URL: srv.URL, Secret: secret, CacheTTL: 100 * time.Millisecond})
+
+	c := conn.New()
+	require.Nil(t, c.SetPresence(testutil.RandStr()))
+	ch := testutil.RandStr()
+
+	assertAuthorize := func(c conn.Conn, action string, expected bool, expectedReqs int) {
+		ok, err := a.authorize(action, c, ch)
+		require.Nil(t, err)
+		assert.Equal(t, expected, ok)
+		assert.Len(t, reqCh, expectedReqs)
+	}
+
+	assertAuthorize(c, ActionSub, true, 1)
+	assertAuthorize(c, ActionSub, true, 1)
+
+	// a different connection with the same presence uses the same entry, but
+	// a different action or presence doesn't
+	c2 := conn.New()
+	require.Nil(t, c2.SetPresence(c.Presence))
+	assertAuthorize(c2, ActionSub, true, 1)
+	assertAuthorize(c, ActionPub, true, 2)
+	assertAuthorize(conn.New(), ActionSub, true, 3)
+
+	// denies are cached too, until they expire
+	atomic.StoreInt32(&deny, 1)
+	assertAuthorize(c, ActionSub, true, 3)
+	time.Sleep(150 * time.Millisecond)
+	assertAuthorize(c, ActionSub, false, 4)
+	assertAuthorize(c, ActionSub, false, 4)
+
+	time.Sleep(150 * time.Millisecond)
+	a.clean()
+	assert.Empty(t, a.cache)
+}
+
+func TestAuthorizeFail(t *testing.T) {
+	secret := testutil.RandStr()
+	c := conn.New()
+
+	srv := newBackend(t, secret, func(Request) int {
+		return http.StatusInternalServerError
+	})
+	defer srv.Close()
+
+	a := newAuthorizer(Opts{URL: srv.URL, Secret: secret, CacheTTL: time.Minute})
+	ok, err := a.authorize(ActionSub, c, testutil.RandStr())
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+	// failures aren't cached
+	assert.Empty(t, a.cache)
+
+	a = newAuthorizer(Opts{URL: srv.URL, Secret: secret, FailOpen: true})
+	ok, err = a.authorize(ActionSub, c, testutil.RandStr())
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	slowSrv := newBackend(t, secret, func(Request) int {
+		time.Sleep(100 * time.Millisecond)
+		return http.StatusOK
+	})
+	defer slowSrv.Close()
+
+	a = newAuthorizer(Opts{URL: slowSrv.URL, Secret: secret, Timeout: 10 * time.Millisecond})
+	ok, err = a.authorize(ActionSub, c, testutil.RandStr())
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}
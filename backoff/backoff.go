@@ -0,0 +1,22 @@
+// Package backoff calculates how long to wait between retries of something
+// which keeps failing, such as a connection or a delivery
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Duration returns the time to wait after the given failed attempt, counting
+// from 1. It's some random time between half and all of min doubled for each
+// previous attempt, capped at max. The jitter keeps many retriers which failed
+// at the same time from all retrying at the same time too.
+func Duration(min, max time.Duration, attempt uint) time.Duration {
+	d := max
+	if attempt < 32 {
+		if dd := min << (attempt - 1); dd > 0 && dd < d {
+			d = dd
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,25 @@
+package backoff
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuration(t *T) {
+	min, max := 100*time.Millisecond, 1*time.Second
+	assertDuration := func(attempt uint, expected time.Duration) {
+		for i := 0; i < 100; i++ {
+			d := Duration(min, max, attempt)
+			assert.True(t, d >= expected/2 && d <= expected, "attempt %d waited %s", attempt, d)
+		}
+	}
+	assertDuration(1, 100*time.Millisecond)
+	assertDuration(2, 200*time.Millisecond)
+	assertDuration(4, 800*time.Millisecond)
+	assertDuration(5, 1*time.Second)
+	// large enough that min would overflow if it kept being doubled
+	assertDuration(40, 1*time.Second)
+	assertDuration(100, 1*time.Second)
+}
@@ -3,13 +3,21 @@
 package conn
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/satori/go.uuid"
+	"github.com/tinylib/msgp/msgp"
 )
 
 //go:generate msgp
+//msgp:ignore Fields
 
 // NodeID is the unique identifier for this node. It should be set before New
 // connections are generated
@@ -30,11 +38,269 @@ func (id ID) NodeID() string {
 	return p[0]
 }
 
-// Conn represents all the information needed to be stored about a connection
+// Conn represents all the information needed to be stored about a connection.
+// When encoded as json the presence is either a string, if Presence is set, or
+// an object, if PresenceFields is set.
+//
+// Since PresenceFields is a map, Conns (and anything containing one, such as a
+// Pub) can't be compared with == or used as map keys. Compare IDs instead.
 type Conn struct {
-	ID        ID     `json:"id"`
-	Presence  string `json:"presence,omitempty"`
-	IsBackend bool   `json:"isBackend,omitempty"`
+	ID       ID
+	Presence string
+	// Set instead of Presence if the connection's presence was a json object
+	PresenceFields Fields
+	IsBackend      bool
+}
+
+type connJSON struct {
+	ID        ID              `json:"id"`
+	Presence  json.RawMessage `json:"presence,omitempty"`
+	IsBackend bool            `json:"isBackend,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (c Conn) MarshalJSON() ([]byte, error) {
+	cj := connJSON{ID: c.ID, IsBackend: c.IsBackend}
+	var err error
+	if c.PresenceFields != nil {
+		cj.Presence, err = json.Marshal(c.PresenceFields)
+	} else if c.Presence != "" {
+		cj.Presence, err = json.Marshal(c.Presence)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cj)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (c *Conn) UnmarshalJSON(b []byte) error {
+	var cj connJSON
+	if err := json.Unmarshal(b, &cj); err != nil {
+		return err
+	}
+	*c = Conn{ID: cj.ID, IsBackend: cj.IsBackend}
+	if len(cj.Presence) == 0 || string(cj.Presence) == "null" {
+		return nil
+	} else if cj.Presence[0] == '{' {
+		var err error
+		c.PresenceFields, err = decodeFields(cj.Presence)
+		return err
+	}
+	return json.Unmarshal(cj.Presence, &c.Presence)
+}
+
+// SetPresence sets either Presence or PresenceFields on the Conn, depending on
+// whether or not the given presence string is a json object. An error is only
+// returned if it looks like an object but can't be decoded as one.
+func (c *Conn) SetPresence(presence string) error {
+	c.Presence, c.PresenceFields = "", nil
+	if !strings.HasPrefix(strings.TrimSpace(presence), "{") {
+		c.Presence = presence
+		return nil
+	}
+	f, err := decodeFields([]byte(presence))
+	if err != nil {
+		return err
+	}
+	c.PresenceFields = f
+	return nil
+}
+
+// PresenceKey returns a string which is the same for all Conns with the same
+// presence, or empty if the Conn has no presence
+func (c Conn) PresenceKey() string {
+	if c.PresenceFields == nil {
+		return c.Presence
+	}
+	// map keys are always encoded in sorted order, so this is consistent
+	b, _ := json.Marshal(c.PresenceFields)
+	return string(b)
+}
+
+// MatchesPresence returns whether the Conn's PresenceFields have all of the
+// given values. Keys are paths into the fields, see Fields.Get, and values are
+// compared to strings as-is and to anything else by its json encoding. A Conn
+// without PresenceFields only matches an empty filter.
+func (c Conn) MatchesPresence(filter map[string]string) bool {
+	for path, want := range filter {
+		v, ok := c.PresenceFields.Get(path)
+		if !ok {
+			return false
+		}
+		if s, ok := v.(string); ok {
+			if s != want {
+				return false
+			}
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil || string(b) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Fields are the decoded fields of a json object. Numbers are decoded as
+// json.Number, so that large integers such as ids don't lose precision. Its
+// msgp encoding always has keys in sorted order, so that the same Fields always
+// encode to the same bytes
+type Fields map[string]interface{}
+
+// decodeFields decodes the given json object, which must be the only thing in
+// the given bytes
+func decodeFields(b []byte) (Fields, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var f Fields
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after json object")
+	}
+	return f, nil
+}
+
+// Get returns the value at the given path in the Fields, where the path is
+// keys separated by periods, e.g. "user.id"
+func (f Fields) Get(path string) (interface{}, bool) {
+	var v interface{} = map[string]interface{}(f)
+	for _, k := range strings.Split(path, ".") {
+		var m map[string]interface{}
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			m = vv
+		case Fields:
+			m = vv
+		default:
+			return nil, false
+		}
+		var ok bool
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (f Fields) MarshalMsg(b []byte) ([]byte, error) {
+	if f == nil {
+		return msgp.AppendNil(b), nil
+	}
+	return appendSorted(b, map[string]interface{}(f))
+}
+
+func appendSorted(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = msgp.AppendMapHeader(b, uint32(len(keys)))
+		for _, k := range keys {
+			b = msgp.AppendString(b, k)
+			if b, err = appendSorted(b, vv[k]); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	case []interface{}:
+		b = msgp.AppendArrayHeader(b, uint32(len(vv)))
+		for _, e := range vv {
+			if b, err = appendSorted(b, e); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	case json.Number:
+		// integers are kept as integers so they don't lose precision
+		if i, err := vv.Int64(); err == nil {
+			return msgp.AppendInt64(b, i), nil
+		} else if u, err := strconv.ParseUint(string(vv), 10, 64); err == nil {
+			return msgp.AppendUint64(b, u), nil
+		}
+		f, err := vv.Float64()
+		if err != nil {
+			return b, err
+		}
+		return msgp.AppendFloat64(b, f), nil
+	}
+	return msgp.AppendIntf(b, v)
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (f *Fields) UnmarshalMsg(b []byte) ([]byte, error) {
+	v, b, err := msgp.ReadIntfBytes(b)
+	if err != nil {
+		return b, err
+	}
+	return b, f.fromIntf(v)
+}
+
+// EncodeMsg implements msgp.Encodable
+func (f Fields) EncodeMsg(w *msgp.Writer) error {
+	b, err := f.MarshalMsg(nil)
+	if err != nil {
+		return err
+	}
+	return w.Append(b...)
+}
+
+// DecodeMsg implements msgp.Decodable
+func (f *Fields) DecodeMsg(r *msgp.Reader) error {
+	v, err := r.ReadIntf()
+	if err != nil {
+		return err
+	}
+	return f.fromIntf(v)
+}
+
+func (f *Fields) fromIntf(v interface{}) error {
+	switch vv := v.(type) {
+	case nil:
+		*f = nil
+	case map[string]interface{}:
+		*f = toNumbers(vv).(map[string]interface{})
+	default:
+		return errors.New("fields are not encoded as a map")
+	}
+	return nil
+}
+
+// toNumbers replaces all numbers decoded from msgp with json.Numbers, to match
+// how Fields are decoded from json
+func toNumbers(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k := range vv {
+			vv[k] = toNumbers(vv[k])
+		}
+	case []interface{}:
+		for i := range vv {
+			vv[i] = toNumbers(vv[i])
+		}
+	case int64:
+		return json.Number(strconv.FormatInt(vv, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(vv, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(vv, 'g', -1, 64))
+	case float32:
+		return json.Number(strconv.FormatFloat(float64(vv), 'g', -1, 32))
+	}
+	return v
+}
+
+// Msgsize implements msgp.Sizer
+func (f Fields) Msgsize() int {
+	b, _ := f.MarshalMsg(nil)
+	return len(b)
 }
 
 // New returns a new Conn object with a brand new ID
@@ -1,10 +1,14 @@
 package conn
 
 import (
+	"bytes"
+	"encoding/json"
 	. "testing"
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinylib/msgp/msgp"
 )
 
 func init() {
@@ -17,3 +21,94 @@ func TestNodeID(t *T) {
 	assert.NotEmpty(t, nid)
 	assert.Equal(t, NodeID, nid)
 }
+
+func TestConnJSON(t *T) {
+	c := New()
+	require.Nil(t, c.SetPresence(testutil.RandStr()))
+	b, err := json.Marshal(c)
+	require.Nil(t, err)
+	var c2 Conn
+	require.Nil(t, json.Unmarshal(b, &c2))
+	assert.Equal(t, c, c2)
+
+	c = New()
+	require.Nil(t, c.SetPresence(`{"user":{"id":123,"name":"foo"},"tags":["a","b"]}`))
+	assert.Empty(t, c.Presence)
+	assert.NotNil(t, c.PresenceFields)
+	b, err = json.Marshal(c)
+	require.Nil(t, err)
+	assert.Contains(t, string(b), `"presence":{`)
+	c2 = Conn{}
+	require.Nil(t, json.Unmarshal(b, &c2))
+	assert.Equal(t, c, c2)
+
+	assert.NotNil(t, c.SetPresence(`{"user":`))
+	assert.NotNil(t, c.SetPresence(`{"user":1}}`))
+	assert.NotNil(t, c.SetPresence(`{"user":1} {}`))
+}
+
+func TestConnLargeNumbers(t *T) {
+	// 2^53 + 1, which can't be represented by a float64
+	const id = "9007199254740993"
+	c := New()
+	require.Nil(t, c.SetPresence(`{"id":`+id+`,"f":1.5,"u":18446744073709551615}`))
+	assert.Equal(t, json.Number(id), c.PresenceFields["id"])
+	assert.True(t, c.MatchesPresence(map[string]string{"id": id}))
+
+	b, err := json.Marshal(c)
+	require.Nil(t, err)
+	assert.Contains(t, string(b), `"id":`+id)
+	var c2 Conn
+	require.Nil(t, json.Unmarshal(b, &c2))
+	assert.Equal(t, c, c2)
+
+	b, err = c.MarshalBinary()
+	require.Nil(t, err)
+	var c3 Conn
+	require.Nil(t, c3.UnmarshalBinary(b))
+	assert.Equal(t, c, c3)
+}
+
+func TestConnMsgp(t *T) {
+	c := New()
+	require.Nil(t, c.SetPresence(`{"b":1,"a":{"y":true,"x":"foo","z":[1,"2"]},"c":null}`))
+
+	b, err := c.MarshalBinary()
+	require.Nil(t, err)
+	// the encoding must be the same every time, otherwise connections
+	// couldn't be unsubscribed
+	for i := 0; i < 10; i++ {
+		b2, err := c.MarshalBinary()
+		require.Nil(t, err)
+		assert.Equal(t, b, b2)
+	}
+	assert.True(t, c.Msgsize() >= len(b))
+
+	var c2 Conn
+	require.Nil(t, c2.UnmarshalBinary(b))
+	assert.Equal(t, c, c2)
+
+	var buf bytes.Buffer
+	require.Nil(t, msgp.Encode(&buf, &c))
+	assert.Equal(t, b, buf.Bytes())
+	var c3 Conn
+	require.Nil(t, msgp.Decode(&buf, &c3))
+	assert.Equal(t, c, c3)
+}
+
+func TestMatchesPresence(t *T) {
+	c := New()
+	require.Nil(t, c.SetPresence(`{"user":{"id":123,"name":"foo"},"admin":true}`))
+
+	assert.True(t, c.MatchesPresence(nil))
+	assert.True(t, c.MatchesPresence(map[string]string{"user.id": "123"}))
+	assert.True(t, c.MatchesPresence(map[string]string{"user.name": "foo", "admin": "true"}))
+	assert.False(t, c.MatchesPresence(map[string]string{"user.name": "bar"}))
+	assert.False(t, c.MatchesPresence(map[string]string{"user.id.foo": "123"}))
+	assert.False(t, c.MatchesPresence(map[string]string{"nope": "foo"}))
+
+	c = New()
+	require.Nil(t, c.SetPresence("foo"))
+	assert.True(t, c.MatchesPresence(nil))
+	assert.False(t, c.MatchesPresence(map[string]string{"user.id": "123"}))
+}
@@ -0,0 +1,224 @@
+package distr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/otter/conn"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Info about each connection is kept in a hash, so it can be looked up by ID.
+// Each node also has a set of its connection IDs, so they can be cleaned up if
+// the node dies, and a set of connection IDs for each presence, so connections
+// can be looked up by presence. All of these share the node's hash tag.
+
+// ConnInfo describes a single connection
+type ConnInfo struct {
+	Conn conn.Conn `json:"connection"`
+
+	// The node the connection is on. This is always taken from the Conn's ID,
+	// so doesn't need to be set when calling AddConnInfo.
+	NodeID string `json:"nodeID"`
+
+	// The channels the connection is subscribed to
+	Channels []string `json:"channels"`
+
+	// When the connection was made
+	Since time.Time `json:"since"`
+
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+func connInfoKey(id conn.ID) string {
+	return fmt.Sprintf("conn:{%s}:%s", id.NodeID(), id)
+}
+
+func connsKey(nodeID string) string {
+	return fmt.Sprintf("conns:{%s}", nodeID)
+}
+
+func presenceIdxKey(nodeID, presenceKey string) string {
+	return fmt.Sprintf("presence:{%s}:%s", nodeID, presenceKey)
+}
+
+// AddConnInfo stores the given info so it can be retrieved by GetConnInfo and
+// GetConnInfosByPresence, until RemoveConnInfo is called or the connection's
+// node is cleaned up by CleanDeadNodes. Updates made with UpdateConn are
+// reflected in it.
+func AddConnInfo(ci ConnInfo) error {
+	return store.addConnInfo(ci)
+}
+
+func (redisStore) addConnInfo(ci ConnInfo) error {
+	b, err := ci.Conn.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	nodeID := ci.Conn.ID.NodeID()
+	cmds := []cmd{
+		newCmd("MULTI"),
+		newCmd("HMSET", connInfoKey(ci.Conn.ID),
+			"conn", b,
+			"channels", strings.Join(ci.Channels, ","),
+			"since", ci.Since.UnixNano(),
+			"addr", ci.RemoteAddr,
+		),
+		newCmd("SADD", connsKey(nodeID), string(ci.Conn.ID)),
+	}
+	if pk := ci.Conn.PresenceKey(); pk != "" {
+		cmds = append(cmds, newCmd("SADD", presenceIdxKey(nodeID, pk), string(ci.Conn.ID)))
+	}
+	cmds = append(cmds, newCmd("EXEC"))
+	return pipeline(connsKey(nodeID), cmds...)
+}
+
+// RemoveConnInfo removes the info stored for the given connection by
+// AddConnInfo. It is safe to call more than once.
+func RemoveConnInfo(c conn.Conn) error {
+	return store.removeConnInfo(c)
+}
+
+func (redisStore) removeConnInfo(c conn.Conn) error {
+	nodeID := c.ID.NodeID()
+	cmds := []cmd{
+		newCmd("MULTI"),
+		newCmd("DEL", connInfoKey(c.ID)),
+		newCmd("SREM", connsKey(nodeID), string(c.ID)),
+	}
+	if pk := c.PresenceKey(); pk != "" {
+		cmds = append(cmds, newCmd("SREM", presenceIdxKey(nodeID, pk), string(c.ID)))
+	}
+	cmds = append(cmds, newCmd("EXEC"))
+	return pipeline(connsKey(nodeID), cmds...)
+}
+
+// updateConnInfo is called by UpdateConn to keep the stored info in sync
+func updateConnInfo(old, new conn.Conn) error {
+	b, err := new.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	nodeID := old.ID.NodeID()
+	cmds := []cmd{
+		newCmd("MULTI"),
+		newCmd("HSET", connInfoKey(old.ID), "conn", b),
+	}
+	if pk := old.PresenceKey(); pk != "" {
+		cmds = append(cmds, newCmd("SREM", presenceIdxKey(nodeID, pk), string(old.ID)))
+	}
+	if pk := new.PresenceKey(); pk != "" {
+		cmds = append(cmds, newCmd("SADD", presenceIdxKey(nodeID, pk), string(new.ID)))
+	}
+	cmds = append(cmds, newCmd("EXEC"))
+	return pipeline(connsKey(nodeID), cmds...)
+}
+
+func parseConnInfo(nodeID string, m map[string]string) (ConnInfo, error) {
+	ci := ConnInfo{
+		NodeID:     nodeID,
+		RemoteAddr: m["addr"],
+	}
+	if err := ci.Conn.UnmarshalBinary([]byte(m["conn"])); err != nil {
+		return ci, err
+	}
+	if m["channels"] != "" {
+		ci.Channels = strings.Split(m["channels"], ",")
+	}
+	since, err := strconv.ParseInt(m["since"], 10, 64)
+	if err != nil {
+		return ci, err
+	}
+	ci.Since = time.Unix(0, since)
+	return ci, nil
+}
+
+// GetConnInfo returns the info stored for the connection with the given ID, if
+// any
+func GetConnInfo(id conn.ID) (ConnInfo, bool, error) {
+	return store.getConnInfo(id)
+}
+
+func (redisStore) getConnInfo(id conn.ID) (ConnInfo, bool, error) {
+	m, err := cmder.Cmd("HGETALL", connInfoKey(id)).Map()
+	if err != nil || len(m) == 0 {
+		return ConnInfo{}, false, err
+	}
+	ci, err := parseConnInfo(id.NodeID(), m)
+	return ci, err == nil, err
+}
+
+// GetConnInfosByPresence returns the info stored for all connections on the
+// given node with the given presence key, see conn.Conn.PresenceKey. The node
+// is assumed to be alive, see GetNodeIDs.
+func GetConnInfosByPresence(nodeID, presenceKey string) ([]ConnInfo, error) {
+	return store.getConnInfosByPresence(nodeID, presenceKey)
+}
+
+func (redisStore) getConnInfosByPresence(nodeID, presenceKey string) ([]ConnInfo, error) {
+	idx := presenceIdxKey(nodeID, presenceKey)
+	var res []ConnInfo
+	err := withConn(idx, func(c *redis.Client) error {
+		ids, err := c.Cmd("SMEMBERS", idx).List()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			c.PipeAppend("HGETALL", connInfoKey(conn.ID(id)))
+		}
+		var rerr error
+		for range ids {
+			m, err := c.PipeResp().Map()
+			if err != nil || len(m) == 0 {
+				if rerr == nil {
+					rerr = err
+				}
+				continue
+			}
+			ci, err := parseConnInfo(nodeID, m)
+			if err != nil {
+				if rerr == nil {
+					rerr = err
+				}
+				continue
+			}
+			res = append(res, ci)
+		}
+		return rerr
+	})
+	return res, err
+}
+
+// cleanConnInfos removes all connection info stored for the given node
+func cleanConnInfos(nodeID string) error {
+	ck := connsKey(nodeID)
+	ids, err := cmder.Cmd("SMEMBERS", ck).List()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		k := connInfoKey(conn.ID(id))
+		b, err := cmder.Cmd("HGET", k, "conn").Bytes()
+		if err == nil {
+			var c conn.Conn
+			if err := c.UnmarshalBinary(b); err == nil {
+				if pk := c.PresenceKey(); pk != "" {
+					if err := cmder.Cmd("DEL", presenceIdxKey(nodeID, pk)).Err; err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := cmder.Cmd("DEL", k).Err; err != nil {
+			return err
+		}
+	}
+
+	return cmder.Cmd("DEL", ck).Err
+}
@@ -0,0 +1,60 @@
+package distr
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnInfo(t *T) {
+	c := conn.New()
+	require.Nil(t, c.SetPresence(testutil.RandStr()))
+	ci := ConnInfo{
+		Conn:       c,
+		NodeID:     conn.NodeID,
+		Channels:   []string{testutil.RandStr(), testutil.RandStr()},
+		Since:      time.Unix(0, time.Now().UnixNano()),
+		RemoteAddr: "127.0.0.1:1234",
+	}
+	require.Nil(t, AddConnInfo(ci))
+
+	ci2, ok, err := GetConnInfo(c.ID)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, ci.Since.Equal(ci2.Since))
+	ci2.Since = ci.Since
+	assert.Equal(t, ci, ci2)
+
+	cis, err := GetConnInfosByPresence(conn.NodeID, c.PresenceKey())
+	require.Nil(t, err)
+	require.Len(t, cis, 1)
+	assert.Equal(t, c, cis[0].Conn)
+
+	// updating the conn should move it to the new presence
+	newC := c
+	require.Nil(t, newC.SetPresence(`{"foo":"bar"}`))
+	require.Nil(t, UpdateConn(c, newC, ci.Channels...))
+	ci2, ok, err = GetConnInfo(c.ID)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, newC, ci2.Conn)
+	cis, err = GetConnInfosByPresence(conn.NodeID, c.PresenceKey())
+	require.Nil(t, err)
+	assert.Empty(t, cis)
+	cis, err = GetConnInfosByPresence(conn.NodeID, newC.PresenceKey())
+	require.Nil(t, err)
+	require.Len(t, cis, 1)
+	assert.Equal(t, newC, cis[0].Conn)
+
+	require.Nil(t, RemoveConnInfo(newC))
+	_, ok, err = GetConnInfo(c.ID)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	cis, err = GetConnInfosByPresence(conn.NodeID, newC.PresenceKey())
+	require.Nil(t, err)
+	assert.Empty(t, cis)
+}
@@ -5,12 +5,10 @@ package distr
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/levenlabs/go-llog"
-	"github.com/levenlabs/golib/radixutil"
 	"github.com/levenlabs/otter/conn"
 	"github.com/mediocregopher/radix.v2/cluster"
 	"github.com/mediocregopher/radix.v2/pool"
@@ -20,46 +18,95 @@ import (
 
 var cmder util.Cmder
 
-func withConn(key string, fn func(*redis.Client)) error {
+func withConn(key string, fn func(*redis.Client) error) error {
 	switch ct := cmder.(type) {
 	case *pool.Pool:
 		conn, err := ct.Get()
 		if err != nil {
 			return err
 		}
-		fn(conn)
-		ct.Put(conn)
+		defer ct.Put(conn)
+		return fn(conn)
 
 	case *cluster.Cluster:
 		conn, err := ct.GetForKey(key)
 		if err != nil {
 			return err
 		}
-		fn(conn)
-		ct.Put(conn)
+		defer ct.Put(conn)
+		return fn(conn)
+
+	case sentinelCmder:
+		conn, err := ct.Get()
+		if err != nil {
+			return err
+		}
+		defer ct.Put(conn)
+		return fn(conn)
 	}
 
 	return nil
 }
 
-// Init initializes the shared util.Cmder instance connected to the given
-// address (single instance or cluster), as well as sets up any necessary
-// go-routines
-func Init(addr string, poolSize, subConnCount int) {
+// cmd describes a single redis command, to be used with pipeline
+type cmd struct {
+	cmd  string
+	args []interface{}
+}
+
+func newCmd(c string, args ...interface{}) cmd {
+	return cmd{cmd: c, args: args}
+}
+
+// pipeline runs all the given commands on a single connection in one round
+// trip. All keys used by the commands must hash to the same slot as key. The
+// first error encountered is returned.
+func pipeline(key string, cmds ...cmd) error {
+	return withConn(key, func(c *redis.Client) error {
+		for _, cm := range cmds {
+			c.PipeAppend(cm.cmd, cm.args...)
+		}
+		var err error
+		for range cmds {
+			if rerr := c.PipeResp().Err; rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+		return err
+	})
+}
+
+// Init initializes the shared util.Cmder instance connected to redis as
+// described by the given Opts (single instance, cluster, or sentinel), as well
+// as sets up any necessary go-routines
+func Init(o Opts) {
+	// an unbuffered queue would make DropOnFull drop almost everything
+	if o.PubQueueSize <= 0 {
+		o.PubQueueSize = DefaultPubQueueSize
+	}
+	opts = o
 	kv := llog.KV{
-		"addr":     addr,
-		"poolSize": poolSize,
+		"addr":     o.Addr,
+		"poolSize": o.PoolSize,
+	}
+	if o.SentinelMaster != "" {
+		kv["sentinelMaster"] = o.SentinelMaster
 	}
 
 	var err error
 	llog.Info("connecting to redis", kv)
-	cmder, err = radixutil.DialMaybeCluster("tcp", addr, poolSize)
+	cmder, err = dialCmder()
 	if err != nil {
 		kv["err"] = err
 		llog.Fatal("error connecting to redis", kv)
 	}
 
-	initSubs(addr, subConnCount)
+	if _, err := Heartbeat(); err != nil {
+		kv["err"] = err
+		llog.Fatal("error registering node", kv)
+	}
+
+	initSubs(o.NumSubConns)
 }
 
 func channelKeyPrefix(nodeID string) string {
@@ -73,42 +120,211 @@ func channelKey(nodeID, channel string, isBackend bool) string {
 	return fmt.Sprintf("%s:%s", channelKeyPrefix(nodeID), channel)
 }
 
-func channelKeyExtractNodeID(key string) string {
-	a, b := strings.Index(key, "{"), strings.Index(key, "}")
-	if a < 0 || b < 0 {
+// channelsKey returns the key of the set of channel names which have (or
+// recently had) subscribers on the given node. It shares a hash tag with the
+// node's channel keys, so they can all be operated on together.
+func channelsKey(nodeID string, isBackend bool) string {
+	if isBackend {
+		return fmt.Sprintf("channels:{%s}:backend", nodeID)
+	}
+	return fmt.Sprintf("channels:{%s}", nodeID)
+}
+
+// channelPresencesKey returns the key of the sorted set of presence keys of the
+// client connections on the given node which are subscribed to the given
+// channel, each scored by how many of those connections have it. This allows
+// distinct presences to be counted without decoding every connection.
+func channelPresencesKey(nodeID, channel string) string {
+	return fmt.Sprintf("chanpresences:{%s}:%s", nodeID, channel)
+}
+
+// presenceArg returns the presence key which should be counted in the channel
+// presence sets for the given connection, or empty if it shouldn't be counted
+func presenceArg(c conn.Conn) string {
+	if c.IsBackend {
 		return ""
 	}
-	return key[a+1 : b]
+	return c.PresenceKey()
+}
+
+// channelKeys returns the channel keys for each of the given channels, followed
+// by the channel presence keys for each of them, as expected by the scripts
+// which modify both
+func channelKeys(c conn.Conn, channels []string) []interface{} {
+	nodeID := c.ID.NodeID()
+	keys := make([]interface{}, 0, len(channels)*2)
+	for _, ch := range channels {
+		keys = append(keys, channelKey(nodeID, ch, c.IsBackend))
+	}
+	for _, ch := range channels {
+		keys = append(keys, channelPresencesKey(nodeID, ch))
+	}
+	return keys
 }
 
-// Subscribe adds the given connection to the set of connections subscribed to
-// the channel. Backend connections get their own set.
-func Subscribe(c conn.Conn, channel string) error {
+// Adds a connection to each of the given channel sets, counting its presence
+// (if any) in the matching presence sets if it wasn't already in the channel
+// set, and adds the channels to the node's channel index, which is the last
+// key
+const subscribeScript = `
+	local n = (#KEYS - 1) / 2
+	for i = 1, n do
+		local added = redis.call("ZADD", KEYS[i], ARGV[1], ARGV[2])
+		if added == 1 and ARGV[3] ~= "" then
+			redis.call("ZINCRBY", KEYS[n+i], 1, ARGV[3])
+		end
+	end
+	redis.call("SADD", KEYS[#KEYS], unpack(ARGV, 4))
+	return 0
+`
+
+// Subscribe adds the given connection to the sets of connections subscribed to
+// each of the given channels. Backend connections get their own sets. All
+// writes are made atomically.
+//
+// Entries are not timed out, they remain until Unsubscribe is called or until
+// the connection's node is cleaned up by CleanDeadNodes.
+func Subscribe(c conn.Conn, channels ...string) error {
+	return store.subscribe(c, channels)
+}
+
+func (redisStore) subscribe(c conn.Conn, channels []string) error {
+	if len(channels) == 0 {
+		return nil
+	}
 	b, err := c.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	k := channelKey(c.ID.NodeID(), channel, c.IsBackend)
-	return cmder.Cmd("ZADD", k, time.Now().UnixNano(), b).Err
+
+	idx := channelsKey(c.ID.NodeID(), c.IsBackend)
+	args := append(channelKeys(c, channels), idx, time.Now().UnixNano(), b, presenceArg(c))
+	for _, ch := range channels {
+		args = append(args, ch)
+	}
+	return withConn(idx, func(rc *redis.Client) error {
+		return util.LuaEval(rc, subscribeScript, len(channels)*2+1, args...).Err
+	})
+}
+
+// Removes a connection from each of the given channel sets, and uncounts its
+// presence (if any) in the matching presence sets if it was in the channel set
+const unsubscribeScript = `
+	local n = #KEYS / 2
+	for i = 1, n do
+		if redis.call("ZREM", KEYS[i], ARGV[1]) == 1 and ARGV[2] ~= "" then
+			if tonumber(redis.call("ZINCRBY", KEYS[n+i], -1, ARGV[2])) <= 0 then
+				redis.call("ZREM", KEYS[n+i], ARGV[2])
+			end
+		end
+	end
+	return 0
+`
+
+// Unsubscribe removes the given connection from the sets of connections
+// subscribed to each of the given channels. All writes are made atomically.
+func Unsubscribe(c conn.Conn, channels ...string) error {
+	return store.unsubscribe(c, channels)
 }
 
-// Unsubscribe removes the given connection from the set of connections
-// subscribed to the channel
-func Unsubscribe(c conn.Conn, channel string) error {
+func (redisStore) unsubscribe(c conn.Conn, channels []string) error {
+	if len(channels) == 0 {
+		return nil
+	}
 	b, err := c.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	k := channelKey(c.ID.NodeID(), channel, c.IsBackend)
-	return cmder.Cmd("ZREM", k, b).Err
+
+	args := append(channelKeys(c, channels), b, presenceArg(c))
+	return withConn(channelsKey(c.ID.NodeID(), c.IsBackend), func(rc *redis.Client) error {
+		return util.LuaEval(rc, unsubscribeScript, len(channels)*2, args...).Err
+	})
+}
+
+// Replaces a connection in each of the channel sets it's in, keeping its
+// original subscribe time, and moves its count in the matching presence sets
+// from its old presence to its new one
+const updateConnScript = `
+	local n = #KEYS / 2
+	for i = 1, n do
+		local score = redis.call("ZSCORE", KEYS[i], ARGV[1])
+		if score then
+			redis.call("ZREM", KEYS[i], ARGV[1])
+			redis.call("ZADD", KEYS[i], score, ARGV[2])
+			if ARGV[3] ~= "" then
+				if tonumber(redis.call("ZINCRBY", KEYS[n+i], -1, ARGV[3])) <= 0 then
+					redis.call("ZREM", KEYS[n+i], ARGV[3])
+				end
+			end
+			if ARGV[4] ~= "" then
+				redis.call("ZINCRBY", KEYS[n+i], 1, ARGV[4])
+			end
+		end
+	end
+	return 0
+`
+
+// UpdateConn replaces the old connection with the new one in the sets of
+// connections subscribed to each of the given channels, e.g. because its
+// presence has changed. Both must have the same ID. All sets are updated
+// atomically. Channels which old isn't subscribed to are left alone. Any info
+// stored with AddConnInfo is updated as well.
+func UpdateConn(old, new conn.Conn, channels ...string) error {
+	return store.updateConn(old, new, channels)
+}
+
+func (redisStore) updateConn(old, new conn.Conn, channels []string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+	oldB, err := old.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	newB, err := new.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	args := append(channelKeys(old, channels), oldB, newB, presenceArg(old), presenceArg(new))
+	err = withConn(channelsKey(old.ID.NodeID(), old.IsBackend), func(c *redis.Client) error {
+		return util.LuaEval(c, updateConnScript, len(channels)*2, args...).Err
+	})
+	if err != nil {
+		return err
+	}
+	return updateConnInfo(old, new)
 }
 
 // GetSubscribed returns the set of connections on the given node which are
-// subscribed to the given channel. Does not include backend connections.
-func GetSubscribed(nodeID, channel string, backend bool, timeout time.Duration) ([]conn.Conn, error) {
+// subscribed to the given channel. Only backend or non-backend connections are
+// returned, depending on the backend argument. The node is assumed to be alive,
+// see GetNodeIDs.
+func GetSubscribed(nodeID, channel string, backend bool) ([]conn.Conn, error) {
+	return store.getSubscribed(nodeID, channel, backend)
+}
+
+func (redisStore) getSubscribed(nodeID, channel string, backend bool) ([]conn.Conn, error) {
+	k := channelKey(nodeID, channel, backend)
+	return getConns(cmder.Cmd("ZRANGE", k, 0, -1))
+}
+
+// GetSubscribedPage is like GetSubscribed, but only returns up to count
+// connections, starting at the given offset into the set, which is ordered by
+// subscribe time. If the set is changed while it's being paged through a
+// connection may be skipped or returned twice.
+func GetSubscribedPage(nodeID, channel string, backend bool, offset, count int) ([]conn.Conn, error) {
+	return store.getSubscribedPage(nodeID, channel, backend, offset, count)
+}
+
+func (redisStore) getSubscribedPage(nodeID, channel string, backend bool, offset, count int) ([]conn.Conn, error) {
 	k := channelKey(nodeID, channel, backend)
-	tlower := time.Now().Add(-timeout).UnixNano()
-	l, err := cmder.Cmd("ZRANGEBYSCORE", k, tlower, "+inf").ListBytes()
+	return getConns(cmder.Cmd("ZRANGE", k, offset, offset+count-1))
+}
+
+func getConns(r *redis.Resp) ([]conn.Conn, error) {
+	l, err := r.ListBytes()
 	if err != nil {
 		return nil, err
 	}
@@ -124,63 +340,167 @@ func GetSubscribed(nodeID, channel string, backend bool, timeout time.Duration)
 	return cc, nil
 }
 
-// CleanChannels runs through all the channels in the cluster and removes
-// entries from them that are older than the given timeout. Only operates on
-// frontend/backend subs in a single call, so this will probably have to be
-// called twice
-func CleanChannels(backend bool, timeout time.Duration) {
-	tupper := time.Now().Add(-timeout).UnixNano()
-	tupperStr := "(" + strconv.FormatInt(tupper, 10)
-
-	it := util.NewScanner(cmder, util.ScanOpts{
-		Command: "SCAN",
-		Pattern: channelKey("*", "*", backend),
-	})
-	for it.HasNext() {
-		k := it.Next()
-		cerr := cmder.Cmd("ZREMRANGEBYSCORE", k, "-inf", tupperStr).Err
-		if cerr != nil {
-			llog.Error("error cleaning channel", llog.KV{
-				"key":     k,
-				"backend": backend,
-				"err":     cerr,
-			})
+// SubscribedTo returns, for each of the given connections, which of the given
+// channels it is subscribed to, in the same order as the channels. All of the
+// connections must be on the given node. All checks are made in a single round
+// trip.
+func SubscribedTo(nodeID string, cc []conn.Conn, channels []string) ([][]bool, error) {
+	return store.subscribedTo(nodeID, cc, channels)
+}
+
+func (redisStore) subscribedTo(nodeID string, cc []conn.Conn, channels []string) ([][]bool, error) {
+	bb := make([][]byte, len(cc))
+	for i := range cc {
+		var err error
+		if bb[i], err = cc[i].MarshalBinary(); err != nil {
+			return nil, err
 		}
 	}
-	if err := it.Err(); err != nil {
-		llog.Error("error scanning for channels to clean", llog.KV{
-			"backend": backend,
-			"err":     err,
-		})
-	}
+
+	res := make([][]bool, len(cc))
+	err := withConn(channelsKey(nodeID, false), func(rc *redis.Client) error {
+		for i := range cc {
+			for _, ch := range channels {
+				rc.PipeAppend("ZSCORE", channelKey(nodeID, ch, cc[i].IsBackend), bb[i])
+			}
+		}
+		var rerr error
+		for i := range cc {
+			res[i] = make([]bool, len(channels))
+			for j := range channels {
+				r := rc.PipeResp()
+				if r.Err != nil {
+					if rerr == nil {
+						rerr = r.Err
+					}
+					continue
+				}
+				res[i][j] = !r.IsType(redis.Nil)
+			}
+		}
+		return rerr
+	})
+	return res, err
 }
 
-// GetNodeIDs returns the IDs of all the currently active nodes. This does a
-// full key scan, so it shouldn't be used in any tight loops.
-func GetNodeIDs() ([]string, error) {
-	// TODO would be nice to have a lua wrapper which simply sets into a sorted
-	// set every time a node does anything
+// CountSubscribed returns the number of connections on the given node which are
+// subscribed to the given channel, without retrieving the connections
+// themselves. Only backend or non-backend connections are counted, depending on
+// the backend argument.
+func CountSubscribed(nodeID, channel string, backend bool) (int, error) {
+	return store.countSubscribed(nodeID, channel, backend)
+}
 
-	it := util.NewScanner(cmder, util.ScanOpts{
-		Command: "SCAN",
-		Pattern: channelKeyPrefix("*") + "*",
-	})
-	m := map[string]struct{}{}
-	for it.HasNext() {
-		k := it.Next()
-		nID := channelKeyExtractNodeID(k)
-		if nID == "" {
-			continue
+func (redisStore) countSubscribed(nodeID, channel string, backend bool) (int, error) {
+	k := channelKey(nodeID, channel, backend)
+	return cmder.Cmd("ZCOUNT", k, "-inf", "+inf").Int()
+}
+
+// GetSubscribedPresences returns the distinct presence keys (see
+// conn.Conn.PresenceKey) of the client connections on the given node which are
+// subscribed to the given channel, without retrieving the connections
+// themselves. Connections with no presence aren't included.
+func GetSubscribedPresences(nodeID, channel string) ([]string, error) {
+	return store.getSubscribedPresences(nodeID, channel)
+}
+
+func (redisStore) getSubscribedPresences(nodeID, channel string) ([]string, error) {
+	return cmder.Cmd("ZRANGE", channelPresencesKey(nodeID, channel), 0, -1).List()
+}
+
+// GetChannelCounts returns the channels on the given node which currently have
+// subscribers, along with the number of subscribers each has. Only backend or
+// non-backend connections are considered, depending on the backend argument.
+// If prefix is not empty only channels starting with it are returned. The node
+// is assumed to be alive, see GetNodeIDs.
+func GetChannelCounts(nodeID string, backend bool, prefix string) (map[string]int, error) {
+	return store.getChannelCounts(nodeID, backend, prefix)
+}
+
+func (redisStore) getChannelCounts(nodeID string, backend bool, prefix string) (map[string]int, error) {
+	idx := channelsKey(nodeID, backend)
+	m := map[string]int{}
+	err := withConn(idx, func(c *redis.Client) error {
+		all, err := c.Cmd("SMEMBERS", idx).List()
+		if err != nil {
+			return err
 		}
-		m[nID] = struct{}{}
-	}
-	if err := it.Err(); err != nil {
-		return nil, err
+		var chs []string
+		for _, ch := range all {
+			if strings.HasPrefix(ch, prefix) {
+				chs = append(chs, ch)
+			}
+		}
+
+		for _, ch := range chs {
+			c.PipeAppend("ZCOUNT", channelKey(nodeID, ch, backend), "-inf", "+inf")
+		}
+		var rerr error
+		for _, ch := range chs {
+			n, err := c.PipeResp().Int()
+			if err != nil {
+				if rerr == nil {
+					rerr = err
+				}
+				continue
+			}
+			// the index may have channels which haven't been cleaned up yet
+			if n > 0 {
+				m[ch] = n
+			}
+		}
+		return rerr
+	})
+	return m, err
+}
+
+// Removes a channel from its node's channel set, along with its presence set,
+// if there's nothing left in the channel's set
+const cleanChannelScript = `
+	if redis.call("ZCARD", KEYS[1]) == 0 then
+		redis.call("DEL", KEYS[3])
+		return redis.call("SREM", KEYS[2], ARGV[1])
+	end
+	return 0
+`
+
+// CleanChannels runs through all the channels this node has had subscribers on
+// and forgets about the ones which have no subscribers left. Only operates on
+// frontend/backend subs in a single call, so this will probably have to be
+// called twice. Channels belonging to other nodes are left to those nodes, or
+// to CleanDeadNodes if the node has died.
+func CleanChannels(backend bool) {
+	store.cleanChannels(backend)
+}
+
+func (redisStore) cleanChannels(backend bool) {
+	idx := channelsKey(conn.NodeID, backend)
+	chs, err := cmder.Cmd("SMEMBERS", idx).List()
+	if err != nil {
+		llog.Error("error getting channels to clean", llog.KV{
+			"backend": backend,
+			"err":     err,
+		})
+		return
 	}
 
-	res := make([]string, 0, len(m))
-	for nID := range m {
-		res = append(res, nID)
+	for _, ch := range chs {
+		k := channelKey(conn.NodeID, ch, backend)
+		cerr := withConn(k, func(c *redis.Client) error {
+			// backends aren't counted in presence sets, so for them the
+			// channel key is given again in its place
+			pk := k
+			if !backend {
+				pk = channelPresencesKey(conn.NodeID, ch)
+			}
+			return util.LuaEval(c, cleanChannelScript, 3, k, idx, pk, ch).Err
+		})
+		if cerr != nil {
+			llog.Error("error cleaning channel", llog.KV{
+				"key":     k,
+				"backend": backend,
+				"err":     cerr,
+			})
+		}
 	}
-	return res, nil
 }
@@ -2,7 +2,6 @@ package distr
 
 import (
 	. "testing"
-	"time"
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/levenlabs/otter/conn"
@@ -11,7 +10,11 @@ import (
 )
 
 func init() {
-	Init("127.0.0.1:6379", 1, 3)
+	Init(Opts{
+		Addr:        "127.0.0.1:6379",
+		PoolSize:    1,
+		NumSubConns: 3,
+	})
 }
 
 func TestSubUnsub(t *T) {
@@ -20,48 +23,175 @@ func TestSubUnsub(t *T) {
 	cb.IsBackend = true
 	ch := testutil.RandStr()
 
-	assertSubscribed := func(timeout time.Duration, clients, backend []conn.Conn) {
-		l, err := GetSubscribed(conn.NodeID, ch, false, timeout)
+	assertSubscribed := func(clients, backend []conn.Conn) {
+		l, err := GetSubscribed(conn.NodeID, ch, false)
 		assert.Nil(t, err)
 		assert.Equal(t, clients, l)
 
-		l, err = GetSubscribed(conn.NodeID, ch, true, timeout)
+		l, err = GetSubscribed(conn.NodeID, ch, true)
 		assert.Nil(t, err)
 		assert.Equal(t, backend, l)
 	}
 
-	assertSubscribed(1*time.Second, []conn.Conn{}, []conn.Conn{})
+	assertSubscribed([]conn.Conn{}, []conn.Conn{})
 
 	require.Nil(t, Subscribe(c, ch))
-	assertSubscribed(1*time.Second, []conn.Conn{c}, []conn.Conn{})
+	assertSubscribed([]conn.Conn{c}, []conn.Conn{})
 	require.Nil(t, Subscribe(cb, ch))
-	assertSubscribed(1*time.Second, []conn.Conn{c}, []conn.Conn{cb})
+	assertSubscribed([]conn.Conn{c}, []conn.Conn{cb})
+
+	n, err := CountSubscribed(conn.NodeID, ch, false)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n)
+	n, err = CountSubscribed(conn.NodeID, testutil.RandStr(), false)
+	require.Nil(t, err)
+	assert.Equal(t, 0, n)
 
 	// Make sure duplicate subscribing doesn't do anything
 	require.Nil(t, Subscribe(c, ch))
-	assertSubscribed(1*time.Second, []conn.Conn{c}, []conn.Conn{cb})
+	assertSubscribed([]conn.Conn{c}, []conn.Conn{cb})
 	require.Nil(t, Subscribe(cb, ch))
-	assertSubscribed(1*time.Second, []conn.Conn{c}, []conn.Conn{cb})
-
-	// Make sure timeout on GetSubscribed does the right thing
-	time.Sleep(100 * time.Millisecond)
-	assertSubscribed(100*time.Millisecond, []conn.Conn{}, []conn.Conn{})
+	assertSubscribed([]conn.Conn{c}, []conn.Conn{cb})
 
 	require.Nil(t, Unsubscribe(c, ch))
-	assertSubscribed(1*time.Second, []conn.Conn{}, []conn.Conn{cb})
+	assertSubscribed([]conn.Conn{}, []conn.Conn{cb})
 	require.Nil(t, Unsubscribe(cb, ch))
-	assertSubscribed(1*time.Second, []conn.Conn{}, []conn.Conn{})
+	assertSubscribed([]conn.Conn{}, []conn.Conn{})
 
-	// Make sure cleanup works correctly
-	require.Nil(t, Subscribe(c, ch))
-	require.Nil(t, Subscribe(cb, ch))
-	time.Sleep(100 * time.Millisecond)
-	CleanChannels(true, 100*time.Millisecond)
-	CleanChannels(false, 100*time.Millisecond)
-	zcount, err := cmder.Cmd("ZCARD", channelKey(conn.NodeID, ch, false)).Int()
+	// Make sure cleanup forgets about empty channels, but not ones which still
+	// have subscribers
+	ch2 := testutil.RandStr()
+	require.Nil(t, Subscribe(c, ch, ch2))
+	require.Nil(t, Unsubscribe(c, ch))
+	CleanChannels(false)
+	chs, err := cmder.Cmd("SMEMBERS", channelsKey(conn.NodeID, false)).List()
 	require.Nil(t, err)
-	assert.Zero(t, zcount)
-	zcount, err = cmder.Cmd("ZCARD", channelKey(conn.NodeID, ch, true)).Int()
+	assert.NotContains(t, chs, ch)
+	assert.Contains(t, chs, ch2)
+	require.Nil(t, Unsubscribe(c, ch2))
+}
+
+func TestUpdateConn(t *T) {
+	c := conn.New()
+	require.Nil(t, c.SetPresence(testutil.RandStr()))
+	ch, ch2, ch3 := testutil.RandStr(), testutil.RandStr(), testutil.RandStr()
+	require.Nil(t, Subscribe(c, ch, ch2))
+
+	c2 := c
+	require.Nil(t, c2.SetPresence(`{"away":true}`))
+	require.Nil(t, UpdateConn(c, c2, ch, ch2, ch3))
+
+	for _, ch := range []string{ch, ch2} {
+		l, err := GetSubscribed(conn.NodeID, ch, false)
+		require.Nil(t, err)
+		assert.Equal(t, []conn.Conn{c2}, l)
+	}
+	// ch3 was never subscribed to, so shouldn't have been touched
+	l, err := GetSubscribed(conn.NodeID, ch3, false)
 	require.Nil(t, err)
-	assert.Zero(t, zcount)
+	assert.Empty(t, l)
+
+	require.Nil(t, Unsubscribe(c2, ch, ch2))
+	l, err = GetSubscribed(conn.NodeID, ch, false)
+	require.Nil(t, err)
+	assert.Empty(t, l)
+}
+
+func TestGetSubscribedPage(t *T) {
+	ch, ch2 := testutil.RandStr(), testutil.RandStr()
+	cc := []conn.Conn{conn.New(), conn.New(), conn.New()}
+	for _, c := range cc {
+		require.Nil(t, Subscribe(c, ch))
+	}
+	require.Nil(t, Subscribe(cc[1], ch2))
+
+	var got []conn.Conn
+	for offset := 0; ; offset += 2 {
+		page, err := GetSubscribedPage(conn.NodeID, ch, false, offset, 2)
+		require.Nil(t, err)
+		got = append(got, page...)
+		if len(page) < 2 {
+			break
+		}
+	}
+	assert.ElementsMatch(t, cc, got)
+
+	subbedTo, err := SubscribedTo(conn.NodeID, cc, []string{ch, ch2})
+	require.Nil(t, err)
+	assert.Equal(t, [][]bool{{true, false}, {true, true}, {true, false}}, subbedTo)
+
+	for _, c := range cc {
+		require.Nil(t, Unsubscribe(c, ch, ch2))
+	}
+}
+
+func TestGetSubscribedPresences(t *T) {
+	ch := testutil.RandStr()
+	pr, pr2 := testutil.RandStr(), testutil.RandStr()
+	mkConn := func(presence string) conn.Conn {
+		c := conn.New()
+		require.Nil(t, c.SetPresence(presence))
+		return c
+	}
+	c, c2, c3, c4 := mkConn(pr), mkConn(pr), mkConn(pr2), mkConn("")
+	cb := conn.New()
+	cb.IsBackend = true
+	require.Nil(t, cb.SetPresence("backend"))
+
+	assertPresences := func(expected ...string) {
+		pks, err := GetSubscribedPresences(conn.NodeID, ch)
+		require.Nil(t, err)
+		assert.ElementsMatch(t, expected, pks)
+	}
+
+	for _, c := range []conn.Conn{c, c2, c3, c4, cb} {
+		require.Nil(t, Subscribe(c, ch))
+	}
+	// subscribing again shouldn't count twice
+	require.Nil(t, Subscribe(c3, ch))
+	assertPresences(pr, pr2)
+
+	require.Nil(t, Unsubscribe(c3, ch))
+	require.Nil(t, Unsubscribe(c3, ch))
+	assertPresences(pr)
+
+	// pr is still had by c2
+	c5 := c
+	require.Nil(t, c5.SetPresence(pr2))
+	require.Nil(t, UpdateConn(c, c5, ch))
+	assertPresences(pr, pr2)
+
+	require.Nil(t, Unsubscribe(c2, ch))
+	assertPresences(pr2)
+
+	for _, c := range []conn.Conn{c5, c4, cb} {
+		require.Nil(t, Unsubscribe(c, ch))
+	}
+	assertPresences()
+}
+
+func TestGetChannelCounts(t *T) {
+	prefix := testutil.RandStr()
+	ch, ch2 := prefix+testutil.RandStr(), prefix+testutil.RandStr()
+	c, c2 := conn.New(), conn.New()
+	require.Nil(t, Subscribe(c, ch, ch2))
+	require.Nil(t, Subscribe(c2, ch))
+
+	m, err := GetChannelCounts(conn.NodeID, false, prefix)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{ch: 2, ch2: 1}, m)
+
+	m, err = GetChannelCounts(conn.NodeID, false, ch2)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{ch2: 1}, m)
+
+	// channels with no subscribers left shouldn't be returned, even if they
+	// haven't been cleaned yet
+	require.Nil(t, Unsubscribe(c, ch2))
+	m, err = GetChannelCounts(conn.NodeID, false, prefix)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{ch: 2}, m)
+
+	require.Nil(t, Unsubscribe(c, ch))
+	require.Nil(t, Unsubscribe(c2, ch))
 }
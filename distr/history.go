@@ -0,0 +1,58 @@
+package distr
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Channels whose namespace has a history size keep their most recent
+// publishes, from clients and backend applications alike, in a list, newest
+// first. Unlike other keys these aren't tied to a node, since publishes aren't
+// either.
+
+func historyKey(channel string) string {
+	return fmt.Sprintf("history:%s", channel)
+}
+
+// addHistory is called by Publish to record the given Pub, keeping no more than
+// size publishes for its channel
+func addHistory(p Pub, size int) error {
+	return store.addHistory(p, size)
+}
+
+func (redisStore) addHistory(p Pub, size int) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	k := historyKey(p.Channel)
+	return pipeline(k,
+		newCmd("MULTI"),
+		newCmd("LPUSH", k, b),
+		newCmd("LTRIM", k, 0, size-1),
+		newCmd("EXEC"),
+	)
+}
+
+// GetHistory returns the publishes recorded for the given channel, oldest
+// first. Publishes are only recorded if the channel's namespace has a history
+// size.
+func GetHistory(channel string) ([]Pub, error) {
+	return store.getHistory(channel)
+}
+
+func (redisStore) getHistory(channel string) ([]Pub, error) {
+	l, err := cmder.Cmd("LRANGE", historyKey(channel), 0, -1).ListBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	pp := make([]Pub, len(l))
+	for i := range l {
+		if err := json.Unmarshal(l[i], &pp[len(l)-1-i]); err != nil {
+			return nil, err
+		}
+	}
+	return pp, nil
+}
@@ -0,0 +1,61 @@
+package distr
+
+import (
+	"encoding/json"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/namespace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacePublish(t *T) {
+	prefix := testutil.RandStr() + ":"
+	namespace.Set(namespace.Namespaces{
+		prefix + "*": {HistorySize: 2, MaxMessageSize: 10},
+	})
+	defer namespace.Set(nil)
+
+	backend := conn.New()
+	backend.IsBackend = true
+	client := conn.New()
+	ch := prefix + testutil.RandStr()
+
+	mkPub := func(c conn.Conn, msg string) Pub {
+		m := json.RawMessage(msg)
+		return Pub{Type: "pub", Conn: c, Channel: ch, Message: &m}
+	}
+	requireRcv := func(p Pub) {
+		select {
+		case p2 := <-PubCh:
+			assert.Equal(t, p, p2)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timedout out waiting for publish")
+		}
+	}
+
+	// presence events aren't sent for the namespace
+	require.Nil(t, Publish(Pub{Type: "sub", Conn: client, Channel: ch}))
+
+	assert.Equal(t, ErrMessageTooLarge, Publish(mkPub(backend, `"0123456789"`)))
+
+	// publishes from both backends and clients are kept, but only the last two
+	var pp []Pub
+	for _, c := range []conn.Conn{backend, client, backend} {
+		p := mkPub(c, `"`+testutil.RandStr()[:4]+`"`)
+		require.Nil(t, Publish(p))
+		requireRcv(p)
+		pp = append(pp, p)
+	}
+
+	h, err := GetHistory(ch)
+	require.Nil(t, err)
+	assert.Equal(t, pp[1:], h)
+
+	h, err = GetHistory(testutil.RandStr())
+	require.Nil(t, err)
+	assert.Empty(t, h)
+}
@@ -0,0 +1,268 @@
+package distr
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/otter/conn"
+	"github.com/mediocregopher/radix.v2/pubsub"
+)
+
+// In interest mode (see Opts.InterestBuckets) each channel is hashed into a
+// bucket, and publishes for the channel are sent to that bucket's pubsub key.
+// Each node only subscribes to the bucket keys which its local connections are
+// interested in, so nodes don't receive publishes nobody on them cares about.
+//
+// Buckets are spread across NumSubConns connections. Since a connection which
+// is blocked on receiving can't be used to subscribe to anything, each
+// connection is also subscribed to a wake key specific to it. Publishing to
+// the wake key causes the connection to sync up its subscriptions with what
+// it's supposed to have.
+
+var errInterestTimeout = errors.New("timed out waiting for interest subscription")
+
+// how long AddInterest will wait for new subscriptions to be made
+var interestTimeout = 5 * time.Second
+
+func interestEnabled() bool {
+	return opts.InterestBuckets > 0 && !opts.Streams
+}
+
+func interestKey(bucket int) string {
+	return fmt.Sprintf("interest:%d", bucket)
+}
+
+func interestBucket(channel string) int {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return int(h.Sum32() % uint32(opts.InterestBuckets))
+}
+
+type interestConn struct {
+	wakeKey string
+	q       *pubQueue
+
+	l sync.Mutex
+	// number of local subscriptions interested in each bucket
+	want map[int]int
+	// closed once the next sync has been completed
+	waiting []chan struct{}
+}
+
+var interestConns []*interestConn
+
+func initInterest(count int) {
+	interestConns = make([]*interestConn, count)
+	for i := range interestConns {
+		ic := &interestConn{
+			wakeKey: fmt.Sprintf("interest:wake:%s:%d", conn.NodeID, i),
+			q:       newPubQueue(true),
+			want:    map[int]int{},
+		}
+		interestConns[i] = ic
+		go ic.spin(i)
+	}
+}
+
+func (ic *interestConn) wake() error {
+	return cmder.Cmd("PUBLISH", ic.wakeKey, "").Err
+}
+
+// AddInterest marks that a local connection is subscribed to the given
+// channels, so this node needs to receive publishes for them. It will block
+// until any necessary subscriptions have been made. Each call should be matched
+// by a call to RemoveInterest. This does nothing unless interest mode is
+// enabled.
+func AddInterest(channels ...string) error {
+	if !interestEnabled() {
+		return nil
+	}
+
+	var waitChs []chan struct{}
+	for ic, bb := range groupBuckets(channels) {
+		var isNew bool
+		ic.l.Lock()
+		for _, b := range bb {
+			if ic.want[b]++; ic.want[b] == 1 {
+				isNew = true
+			}
+		}
+		if isNew {
+			waitCh := make(chan struct{})
+			ic.waiting = append(ic.waiting, waitCh)
+			waitChs = append(waitChs, waitCh)
+		}
+		ic.l.Unlock()
+
+		if isNew {
+			if err := ic.wake(); err != nil {
+				return err
+			}
+		}
+	}
+
+	timeout := time.After(interestTimeout)
+	for _, waitCh := range waitChs {
+		select {
+		case <-waitCh:
+		case <-timeout:
+			return errInterestTimeout
+		}
+	}
+	return nil
+}
+
+// RemoveInterest undoes a previous call to AddInterest with the same channels.
+// This does nothing unless interest mode is enabled.
+func RemoveInterest(channels ...string) {
+	if !interestEnabled() {
+		return
+	}
+
+	for ic, bb := range groupBuckets(channels) {
+		var isGone bool
+		ic.l.Lock()
+		for _, b := range bb {
+			if ic.want[b]--; ic.want[b] <= 0 {
+				delete(ic.want, b)
+				isGone = true
+			}
+		}
+		ic.l.Unlock()
+
+		if isGone {
+			if err := ic.wake(); err != nil {
+				llog.Error("error waking interest conn", llog.KV{"err": err})
+			}
+		}
+	}
+}
+
+// groupBuckets returns the buckets for the given channels, grouped by the
+// interestConn responsible for them
+func groupBuckets(channels []string) map[*interestConn][]int {
+	m := map[*interestConn][]int{}
+	for _, ch := range channels {
+		b := interestBucket(ch)
+		ic := interestConns[b%len(interestConns)]
+		m[ic] = append(m[ic], b)
+	}
+	return m
+}
+
+func (ic *interestConn) spin(i int) {
+	for first := true; ; first = false {
+		if !first {
+			time.Sleep(1 * time.Second)
+		}
+
+		kv := llog.KV{"i": i}
+		addr, err := subAddr(ic.wakeKey)
+		if err != nil {
+			kv["err"] = err
+			llog.Error("could not get address for interest connection", kv)
+			resetTopology()
+			continue
+		}
+		kv["addr"] = addr
+
+		llog.Info("starting interest connection", kv)
+		c, err := dial("tcp", addr)
+		if err != nil {
+			kv["err"] = err
+			llog.Error("could not start interest connection", kv)
+			resetTopology()
+			continue
+		}
+
+		err = ic.read(pubsub.NewSubClient(c))
+		c.Close()
+		kv["err"] = err
+		llog.Error("interest connection closed", kv)
+		resetTopology()
+	}
+}
+
+func (ic *interestConn) read(subc *pubsub.SubClient) error {
+	if err := subc.Subscribe(ic.wakeKey).Err; err != nil {
+		return err
+	}
+
+	subbed := map[int]bool{}
+	if err := ic.sync(subc, subbed); err != nil {
+		return err
+	}
+
+	for {
+		r := subc.Receive()
+		if r.Timeout() {
+			continue
+		} else if r.Err != nil {
+			return r.Err
+		}
+
+		if r.Channel == ic.wakeKey {
+			if err := ic.sync(subc, subbed); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := ic.q.handle([]byte(r.Message)); err != nil {
+			return err
+		}
+	}
+}
+
+// sync subscribes and unsubscribes from bucket keys so that the ones in subbed
+// match the ones in want
+func (ic *interestConn) sync(subc *pubsub.SubClient, subbed map[int]bool) error {
+	ic.l.Lock()
+	var toSub, toUnsub []int
+	for b := range ic.want {
+		if !subbed[b] {
+			toSub = append(toSub, b)
+		}
+	}
+	for b := range subbed {
+		if _, ok := ic.want[b]; !ok {
+			toUnsub = append(toUnsub, b)
+		}
+	}
+	waiting := ic.waiting
+	ic.waiting = nil
+	ic.l.Unlock()
+
+	if err := ic.apply(subc, subbed, toSub, toUnsub); err != nil {
+		// the next successful sync will take care of the waiters
+		ic.l.Lock()
+		ic.waiting = append(ic.waiting, waiting...)
+		ic.l.Unlock()
+		return err
+	}
+
+	for _, waitCh := range waiting {
+		close(waitCh)
+	}
+	return nil
+}
+
+func (ic *interestConn) apply(subc *pubsub.SubClient, subbed map[int]bool, toSub, toUnsub []int) error {
+	for _, b := range toSub {
+		if err := subc.Subscribe(interestKey(b)).Err; err != nil {
+			return err
+		}
+		subbed[b] = true
+	}
+	for _, b := range toUnsub {
+		if err := subc.Unsubscribe(interestKey(b)).Err; err != nil {
+			return err
+		}
+		delete(subbed, b)
+	}
+	return nil
+}
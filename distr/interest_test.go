@@ -0,0 +1,42 @@
+package distr
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterest(t *T) {
+	opts.InterestBuckets = 128
+	defer func() { opts.InterestBuckets = 0 }()
+	initInterest(2)
+
+	p := Pub{
+		Type:    "pub",
+		Conn:    conn.New(),
+		Channel: testutil.RandStr(),
+	}
+
+	require.Nil(t, AddInterest(p.Channel))
+	require.Nil(t, Publish(p))
+	select {
+	case p2 := <-PubCh:
+		assert.Equal(t, p, p2)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timedout out waiting for publish")
+	}
+
+	RemoveInterest(p.Channel)
+	// RemoveInterest doesn't wait for the unsubscribe to go through
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, Publish(p))
+	select {
+	case p2 := <-PubCh:
+		t.Fatalf("received publish after removing interest: %#v", p2)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
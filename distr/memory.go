@@ -0,0 +1,231 @@
+package distr
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/otter/conn"
+)
+
+// memStore is the storage used in place of redis when InitMemory is used. Everything is
+// kept local to this process, which is treated as the only node.
+type memStore struct {
+	l sync.RWMutex
+	// keyed by channelKey
+	chans map[string]map[conn.ID]conn.Conn
+	// keyed by channelsKey, the channel names which have subscribers
+	idx map[string]map[string]struct{}
+
+	infos map[conn.ID]ConnInfo
+
+	// keyed by channel, oldest first
+	history map[string][]Pub
+}
+
+// InitMemory initializes distr to keep all of its data in memory, rather than
+// in redis. Nothing is shared between processes, so this is really only useful
+// for tests. It should be called instead of Init.
+func InitMemory() {
+	store = &memStore{
+		chans:   map[string]map[conn.ID]conn.Conn{},
+		idx:     map[string]map[string]struct{}{},
+		infos:   map[conn.ID]ConnInfo{},
+		history: map[string][]Pub{},
+	}
+}
+
+func (m *memStore) subscribe(c conn.Conn, channels []string) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, ch := range channels {
+		k := channelKey(c.ID.NodeID(), ch, c.IsBackend)
+		if m.chans[k] == nil {
+			m.chans[k] = map[conn.ID]conn.Conn{}
+		}
+		m.chans[k][c.ID] = c
+
+		idx := channelsKey(c.ID.NodeID(), c.IsBackend)
+		if m.idx[idx] == nil {
+			m.idx[idx] = map[string]struct{}{}
+		}
+		m.idx[idx][ch] = struct{}{}
+	}
+	return nil
+}
+
+func (m *memStore) unsubscribe(c conn.Conn, channels []string) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, ch := range channels {
+		k := channelKey(c.ID.NodeID(), ch, c.IsBackend)
+		delete(m.chans[k], c.ID)
+		if len(m.chans[k]) == 0 {
+			delete(m.chans, k)
+			delete(m.idx[channelsKey(c.ID.NodeID(), c.IsBackend)], ch)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) updateConn(old, new conn.Conn, channels []string) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, ch := range channels {
+		k := channelKey(old.ID.NodeID(), ch, old.IsBackend)
+		if _, ok := m.chans[k][old.ID]; ok {
+			m.chans[k][old.ID] = new
+		}
+	}
+	if ci, ok := m.infos[old.ID]; ok {
+		ci.Conn = new
+		m.infos[old.ID] = ci
+	}
+	return nil
+}
+
+func (m *memStore) addConnInfo(ci ConnInfo) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	ci.NodeID = ci.Conn.ID.NodeID()
+	m.infos[ci.Conn.ID] = ci
+	return nil
+}
+
+func (m *memStore) removeConnInfo(c conn.Conn) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	delete(m.infos, c.ID)
+	return nil
+}
+
+func (m *memStore) getConnInfo(id conn.ID) (ConnInfo, bool, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	ci, ok := m.infos[id]
+	return ci, ok, nil
+}
+
+func (m *memStore) getConnInfosByPresence(nodeID, presenceKey string) ([]ConnInfo, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	var res []ConnInfo
+	for _, ci := range m.infos {
+		if ci.NodeID == nodeID && ci.Conn.PresenceKey() == presenceKey {
+			res = append(res, ci)
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) getSubscribed(nodeID, channel string, backend bool) ([]conn.Conn, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	cm := m.chans[channelKey(nodeID, channel, backend)]
+	cc := make([]conn.Conn, 0, len(cm))
+	for _, c := range cm {
+		cc = append(cc, c)
+	}
+	return cc, nil
+}
+
+func (m *memStore) getSubscribedPage(nodeID, channel string, backend bool, offset, count int) ([]conn.Conn, error) {
+	// there's no subscribe time kept, so order by ID instead to keep pages
+	// consistent
+	cc, _ := m.getSubscribed(nodeID, channel, backend)
+	sort.Slice(cc, func(i, j int) bool { return cc[i].ID < cc[j].ID })
+	if offset >= len(cc) {
+		return []conn.Conn{}, nil
+	}
+	cc = cc[offset:]
+	if count < len(cc) {
+		cc = cc[:count]
+	}
+	return cc, nil
+}
+
+func (m *memStore) subscribedTo(nodeID string, cc []conn.Conn, channels []string) ([][]bool, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	res := make([][]bool, len(cc))
+	for i, c := range cc {
+		res[i] = make([]bool, len(channels))
+		for j, ch := range channels {
+			_, res[i][j] = m.chans[channelKey(nodeID, ch, c.IsBackend)][c.ID]
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) countSubscribed(nodeID, channel string, backend bool) (int, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return len(m.chans[channelKey(nodeID, channel, backend)]), nil
+}
+
+func (m *memStore) getSubscribedPresences(nodeID, channel string) ([]string, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	pm := map[string]struct{}{}
+	for _, c := range m.chans[channelKey(nodeID, channel, false)] {
+		if pk := c.PresenceKey(); pk != "" {
+			pm[pk] = struct{}{}
+		}
+	}
+	res := make([]string, 0, len(pm))
+	for pk := range pm {
+		res = append(res, pk)
+	}
+	return res, nil
+}
+
+func (m *memStore) getChannelCounts(nodeID string, backend bool, prefix string) (map[string]int, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	res := map[string]int{}
+	for ch := range m.idx[channelsKey(nodeID, backend)] {
+		if strings.HasPrefix(ch, prefix) {
+			res[ch] = len(m.chans[channelKey(nodeID, ch, backend)])
+		}
+	}
+	return res, nil
+}
+
+func (m *memStore) cleanChannels(backend bool) {
+	// channels are forgotten as soon as they have no subscribers
+}
+
+func (m *memStore) heartbeat() (bool, error) {
+	return false, nil
+}
+
+func (m *memStore) getNodeIDs(timeout time.Duration) ([]string, error) {
+	return []string{conn.NodeID}, nil
+}
+
+func (m *memStore) cleanDeadNodes(timeout time.Duration) {
+	// this process is the only node, so there are never any dead ones
+}
+
+func (m *memStore) publish(p Pub) error {
+	PubCh <- p
+	return nil
+}
+
+func (m *memStore) addHistory(p Pub, size int) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	h := append(m.history[p.Channel], p)
+	if len(h) > size {
+		h = append([]Pub(nil), h[len(h)-size:]...)
+	}
+	m.history[p.Channel] = h
+	return nil
+}
+
+func (m *memStore) getHistory(channel string) ([]Pub, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return append([]Pub{}, m.history[channel]...), nil
+}
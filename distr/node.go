@@ -0,0 +1,178 @@
+package distr
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/otter/conn"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/util"
+)
+
+// nodesKey is a sorted set of node IDs, scored by the last time each node sent
+// a heartbeat
+const nodesKey = "nodes"
+
+// cleanerKey holds the ID of the node which is currently responsible for
+// cleaning up after dead nodes
+const cleanerKey = "cleaner"
+
+// registered is set once Heartbeat has added this node to nodesKey. Heartbeat
+// is only ever called from one go-routine at a time.
+var registered bool
+
+// Heartbeat marks this node as being alive. It should be called periodically,
+// and more often than the timeout passed into GetNodeIDs and CleanDeadNodes.
+//
+// If the node has missed enough heartbeats, e.g. because redis couldn't be
+// reached, another node will have considered it dead and cleaned up all of its
+// data. In that case true is returned, and every connection on this node needs
+// to be subscribed again (along with its ConnInfo) in order to keep receiving
+// publishes.
+func Heartbeat() (bool, error) {
+	return store.heartbeat()
+}
+
+func (redisStore) heartbeat() (bool, error) {
+	// ZADD returns the number of members added, which will only be 1 the first
+	// time or if the cleaner has removed this node
+	n, err := cmder.Cmd("ZADD", nodesKey, time.Now().UnixNano(), conn.NodeID).Int()
+	if err != nil {
+		return false, err
+	}
+	cleaned := registered && n == 1
+	registered = true
+	return cleaned, nil
+}
+
+// GetNodeIDs returns the IDs of all the nodes which have sent a heartbeat within
+// the given timeout
+func GetNodeIDs(timeout time.Duration) ([]string, error) {
+	return store.getNodeIDs(timeout)
+}
+
+func (redisStore) getNodeIDs(timeout time.Duration) ([]string, error) {
+	tlower := time.Now().Add(-timeout).UnixNano()
+	return cmder.Cmd("ZRANGEBYSCORE", nodesKey, tlower, "+inf").List()
+}
+
+// Sets the cleaner key to this node if no other node holds it, or extends it if
+// this node already does. Returns 1 if this node is the cleaner
+const becomeCleanerScript = `
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+		return 1
+	end
+	return 0
+`
+
+func becomeCleaner(timeout time.Duration) (bool, error) {
+	ms := int64(timeout / time.Millisecond)
+	var i int
+	err := withConn(cleanerKey, func(c *redis.Client) error {
+		var err error
+		i, err = util.LuaEval(c, becomeCleanerScript, 1, cleanerKey, conn.NodeID, ms).Int()
+		return err
+	})
+	return i == 1, err
+}
+
+// CleanDeadNodes looks for nodes which haven't sent a heartbeat within the
+// given timeout and removes all of their data. An unsub publish is sent for
+// every connection the dead node had, as though each had closed normally, so
+// that backends are notified of clients going away and vice-versa. Only one
+// node in the cluster will actually do this work at a time, so it's safe to
+// call this periodically on every node.
+func CleanDeadNodes(timeout time.Duration) {
+	store.cleanDeadNodes(timeout)
+}
+
+func (redisStore) cleanDeadNodes(timeout time.Duration) {
+	ok, err := becomeCleaner(timeout)
+	if err != nil {
+		llog.Error("error checking for cleaner role", llog.KV{"err": err})
+		return
+	} else if !ok {
+		return
+	}
+
+	tupper := time.Now().Add(-timeout).UnixNano()
+	tupperStr := "(" + strconv.FormatInt(tupper, 10)
+	nIDs, err := cmder.Cmd("ZRANGEBYSCORE", nodesKey, "-inf", tupperStr).List()
+	if err != nil {
+		llog.Error("error getting dead nodes", llog.KV{"err": err})
+		return
+	}
+
+	for _, nID := range nIDs {
+		kv := llog.KV{"deadNodeID": nID}
+		llog.Info("cleaning up dead node", kv)
+		if err := cleanNode(nID); err != nil {
+			kv["err"] = err
+			llog.Error("error cleaning up dead node", kv)
+		}
+	}
+}
+
+func cleanNode(nodeID string) error {
+	for _, backend := range []bool{false, true} {
+		idx := channelsKey(nodeID, backend)
+		chs, err := cmder.Cmd("SMEMBERS", idx).List()
+		if err != nil {
+			return err
+		}
+
+		for _, ch := range chs {
+			k := channelKey(nodeID, ch, backend)
+			// Backend connections publish subs and unsubs too (which go to
+			// clients), so their sets need unsubs published as well
+			if err := publishUnsubs(k, ch); err != nil {
+				return err
+			}
+			if !backend {
+				if err := cmder.Cmd("DEL", channelPresencesKey(nodeID, ch)).Err; err != nil {
+					return err
+				}
+			}
+			if err := cmder.Cmd("DEL", k).Err; err != nil {
+				return err
+			}
+		}
+
+		if err := cmder.Cmd("DEL", idx).Err; err != nil {
+			return err
+		}
+	}
+
+	if err := cleanConnInfos(nodeID); err != nil {
+		return err
+	}
+
+	return cmder.Cmd("ZREM", nodesKey, nodeID).Err
+}
+
+func publishUnsubs(key, channel string) error {
+	l, err := cmder.Cmd("ZRANGE", key, 0, -1).ListBytes()
+	if err != nil {
+		return err
+	}
+
+	for i := range l {
+		var c conn.Conn
+		if err := c.UnmarshalBinary(l[i]); err != nil {
+			return err
+		}
+		err := Publish(Pub{
+			Type:    "unsub",
+			Conn:    c,
+			Channel: channel,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package distr
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetNodeIDs(t *T) {
+	nIDs, err := GetNodeIDs(1 * time.Second)
+	require.Nil(t, err)
+	assert.Contains(t, nIDs, conn.NodeID)
+}
+
+func TestCleanDeadNodes(t *T) {
+	deadID := testutil.RandStr()
+	c := conn.Conn{ID: conn.ID(deadID + "_" + testutil.RandStr())}
+	cb := conn.Conn{ID: conn.ID(deadID + "_" + testutil.RandStr()), IsBackend: true}
+	ch := testutil.RandStr()
+
+	require.Nil(t, c.SetPresence(testutil.RandStr()))
+	require.Nil(t, Subscribe(c, ch))
+	require.Nil(t, Subscribe(cb, ch))
+	require.Nil(t, AddConnInfo(ConnInfo{Conn: c, Channels: []string{ch}, Since: time.Now()}))
+	then := time.Now().Add(-1 * time.Minute).UnixNano()
+	require.Nil(t, cmder.Cmd("ZADD", nodesKey, then, deadID).Err)
+	_, err := Heartbeat()
+	require.Nil(t, err)
+
+	nIDs, err := GetNodeIDs(1 * time.Second)
+	require.Nil(t, err)
+	assert.NotContains(t, nIDs, deadID)
+
+	CleanDeadNodes(1 * time.Second)
+
+	// client sets are cleaned before backend ones
+	for _, expected := range []conn.Conn{c, cb} {
+		select {
+		case p := <-PubCh:
+			assert.Equal(t, Pub{Type: "unsub", Conn: expected, Channel: ch}, p)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timedout out waiting for unsub")
+		}
+	}
+
+	for _, k := range []string{
+		channelKey(deadID, ch, false),
+		channelKey(deadID, ch, true),
+		channelPresencesKey(deadID, ch),
+		channelsKey(deadID, false),
+		channelsKey(deadID, true),
+		connInfoKey(c.ID),
+		connsKey(deadID),
+		presenceIdxKey(deadID, c.PresenceKey()),
+	} {
+		exists, err := cmder.Cmd("EXISTS", k).Int()
+		require.Nil(t, err)
+		assert.Zero(t, exists, "key: %q", k)
+	}
+
+	_, err = cmder.Cmd("ZSCORE", nodesKey, deadID).Str()
+	assert.NotNil(t, err)
+}
+
+func TestHeartbeatCleaned(t *T) {
+	cleaned, err := Heartbeat()
+	require.Nil(t, err)
+	assert.False(t, cleaned)
+
+	// simulate this node having been cleaned up by another
+	require.Nil(t, cmder.Cmd("ZREM", nodesKey, conn.NodeID).Err)
+	cleaned, err = Heartbeat()
+	require.Nil(t, err)
+	assert.True(t, cleaned)
+
+	cleaned, err = Heartbeat()
+	require.Nil(t, err)
+	assert.False(t, cleaned)
+}
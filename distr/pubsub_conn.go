@@ -2,21 +2,34 @@ package distr
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"time"
 
 	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/namespace"
 	"github.com/mediocregopher/radix.v2/pubsub"
 	"github.com/mediocregopher/radix.v2/redis"
 )
 
-func initSubs(addr string, count int) {
+func initSubs(count int) {
 	numSubKeys = count
+	go logPubStats(10 * time.Second)
+
+	if opts.Streams {
+		for i := 0; i < count; i++ {
+			go spinStream(i)
+		}
+		return
+	} else if interestEnabled() {
+		initInterest(count)
+		return
+	}
 
 	for i := 0; i < count; i++ {
-		go spinSub(addr, i)
+		go spinSub(i)
 	}
 }
 
@@ -33,7 +46,7 @@ func randSubKey() string {
 // Pub describes a publish message either being sent out to other nodes or being
 // received by this one
 type Pub struct {
-	// Possible types are "pub", "sub", and "unsub"
+	// Possible types are "pub", "sub", "unsub", and "presence"
 	Type    string           `json:"type"`
 	Conn    conn.Conn        `json:"connection"`
 	Channel string           `json:"channel"`
@@ -41,68 +54,171 @@ type Pub struct {
 }
 
 // PubCh is where publishes which are being received by this node are written
-// to. They need to be read off the channel and consumed constantly
+// to. They need to be read off the channel and consumed constantly, see
+// Opts.DropOnFull for what happens if they aren't
 var PubCh = make(chan Pub, 1000)
 
-func spinSub(addr string, i int) {
-	var c *redis.Client
-	var err error
-
-	for {
-		if c != nil {
-			c.Close()
+func spinSub(i int) {
+	q := newPubQueue(true)
+	for first := true; ; first = false {
+		if !first {
 			time.Sleep(1 * time.Second)
 		}
 
-		kv := llog.KV{
-			"addr": addr,
-			"i":    i,
+		kv := llog.KV{"i": i}
+		addr, err := subAddr(subKey(i))
+		if err != nil {
+			kv["err"] = err
+			llog.Error("could not get address for sub connection", kv)
+			resetTopology()
+			continue
 		}
+		kv["addr"] = addr
 
 		llog.Info("starting sub connection", kv)
-		c, err = redis.Dial("tcp", addr)
+		c, err := dial("tcp", addr)
 		if err != nil {
 			kv["err"] = err
 			llog.Error("could not start sub connection", kv)
+			resetTopology()
 			continue
 		}
 
-		subc := pubsub.NewSubClient(c)
-		if err := subc.Subscribe(subKey(i)).Err; err != nil {
-			kv["err"] = err
-			llog.Error("could not subscribe", kv)
+		if opts.ShardedPubSub {
+			err = readShardedSub(c, subKey(i), q)
+		} else {
+			err = readSub(c, subKey(i), q)
+		}
+		c.Close()
+		kv["err"] = err
+		llog.Error("sub connection closed", kv)
+		resetTopology()
+	}
+}
+
+func readSub(c *redis.Client, key string, q *pubQueue) error {
+	subc := pubsub.NewSubClient(c)
+	if err := subc.Subscribe(key).Err; err != nil {
+		return err
+	}
+
+	for {
+		r := subc.Receive()
+		if r.Timeout() {
 			continue
+		} else if r.Err != nil {
+			return r.Err
 		}
 
-		for {
-			r := subc.Receive()
-			if r.Timeout() {
-				continue
-			} else if r.Err != nil {
-				kv["err"] = r.Err
-				llog.Error("error receiving on sub connection", kv)
-				break
-			}
+		if err := q.handle([]byte(r.Message)); err != nil {
+			return err
+		}
+	}
+}
 
-			var p Pub
-			if err := json.Unmarshal([]byte(r.Message), &p); err != nil {
-				kv["err"] = r.Err
-				llog.Error("error decoding pub", kv)
-				break
-			}
+// readShardedSub is like readSub but uses SSUBSCRIBE, which the radix pubsub
+// package doesn't know about. Redis will unsubscribe the connection if the
+// key's slot is moved to a different node, in which case an error is returned
+// so the connection can be remade to the new owner.
+func readShardedSub(c *redis.Client, key string, q *pubQueue) error {
+	if err := c.Cmd("SSUBSCRIBE", key).Err; err != nil {
+		return err
+	}
+
+	for {
+		r := c.ReadResp()
+		if r.Err != nil {
+			return r.Err
+		}
 
-			PubCh <- p
+		arr, err := r.Array()
+		if err != nil {
+			return err
+		} else if len(arr) != 3 {
+			return errors.New("unexpected sharded sub response")
+		}
+
+		typ, _ := arr[0].Str()
+		switch typ {
+		case "smessage":
+			b, err := arr[2].Bytes()
+			if err != nil {
+				return err
+			}
+			if err := q.handle(b); err != nil {
+				return err
+			}
+		case "sunsubscribe":
+			return errors.New("unsubscribed from sharded sub key, slot may have moved")
 		}
 	}
 }
 
+// PublishHook, if set, is called with every Pub which is successfully
+// published by this node, whether by calling Publish directly or by
+// CleanDeadNodes. Since each Pub is only published by one node, this is a way
+// of acting on each once across the whole cluster.
+var PublishHook func(Pub)
+
+// ErrMessageTooLarge is returned from Publish when a Pub's Message is larger
+// than its channel's namespace allows
+var ErrMessageTooLarge = errors.New("message too large")
+
 // Publish sends the given Pub struct to all listening otter instances,
-// including this one
+// including this one. The options of the Pub's channel's namespace are
+// applied: "sub", "unsub" and "presence" Pubs are silently discarded if the
+// namespace doesn't have presence events, and "pub" Pubs are recorded for
+// GetHistory if it has a history size.
 func Publish(p Pub) error {
+	nsOpts := namespace.Get(p.Channel)
+	switch p.Type {
+	case "sub", "unsub", "presence":
+		if !nsOpts.PresenceEvents {
+			return nil
+		}
+	case "pub":
+		if nsOpts.MaxMessageSize > 0 && p.Message != nil && len(*p.Message) > nsOpts.MaxMessageSize {
+			return ErrMessageTooLarge
+		}
+	}
+
+	if err := publish(p); err != nil {
+		return err
+	}
+
+	if p.Type == "pub" && nsOpts.HistorySize > 0 {
+		// the publish has already gone out, so failing to record it isn't
+		// worth failing the whole thing over
+		if err := addHistory(p, nsOpts.HistorySize); err != nil {
+			llog.Error("error adding publish to history", llog.KV{
+				"channel": p.Channel,
+				"err":     err,
+			})
+		}
+	}
+
+	if PublishHook != nil {
+		PublishHook(p)
+	}
+	return nil
+}
+
+func publish(p Pub) error {
+	return store.publish(p)
+}
+
+func (redisStore) publish(p Pub) error {
 	b, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 
+	if opts.Streams {
+		return publishStream(b)
+	} else if interestEnabled() {
+		return cmder.Cmd("PUBLISH", interestKey(interestBucket(p.Channel)), b).Err
+	} else if opts.ShardedPubSub {
+		return cmder.Cmd("SPUBLISH", randSubKey(), b).Err
+	}
 	return cmder.Cmd("PUBLISH", randSubKey(), b).Err
 }
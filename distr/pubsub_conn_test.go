@@ -29,3 +29,33 @@ func TestPublish(t *T) {
 		t.Fatalf("timedout out waiting for publish")
 	}
 }
+
+func TestReadShardedSub(t *T) {
+	c, err := dial("tcp", opts.Addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	key := testutil.RandStr()
+	errCh := make(chan error, 1)
+	go func() { errCh <- readShardedSub(c, key, newPubQueue(false)) }()
+	// give the SSUBSCRIBE a moment to go through
+	time.Sleep(100 * time.Millisecond)
+
+	p := Pub{
+		Type:    "pub",
+		Conn:    conn.New(),
+		Channel: testutil.RandStr(),
+	}
+	b, err := json.Marshal(p)
+	require.Nil(t, err)
+	require.Nil(t, cmder.Cmd("SPUBLISH", key, b).Err)
+
+	select {
+	case p2 := <-PubCh:
+		assert.Equal(t, p, p2)
+	case err := <-errCh:
+		t.Fatalf("readShardedSub returned: %s", err)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timedout out waiting for publish")
+	}
+}
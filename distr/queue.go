@@ -0,0 +1,97 @@
+package distr
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+)
+
+// Each connection which receives publishes from redis writes them to its own
+// pubQueue, which forwards them on to PubCh. This keeps one slow connection
+// from holding up the others, and if DropOnFull is set means redis connections
+// are never blocked on PubCh at all, so redis won't disconnect them for letting
+// their output buffers fill up.
+
+// PubStats contains counters describing the publishes which have been received
+// by this node
+type PubStats struct {
+	// Number of publishes received from redis
+	Received uint64
+
+	// Number of publishes which were dropped because they were received while
+	// their connection's queue was full. Only ever incremented if DropOnFull
+	// is set.
+	Dropped uint64
+}
+
+var pubStats PubStats
+
+// GetPubStats returns the current PubStats for this node
+func GetPubStats() PubStats {
+	return PubStats{
+		Received: atomic.LoadUint64(&pubStats.Received),
+		Dropped:  atomic.LoadUint64(&pubStats.Dropped),
+	}
+}
+
+type pubQueue struct {
+	ch   chan Pub
+	drop bool
+}
+
+// newPubQueue returns a pubQueue which forwards to PubCh. If drop is true
+// publishes are dropped when the queue is full, as long as DropOnFull is also
+// set.
+func newPubQueue(drop bool) *pubQueue {
+	q := &pubQueue{
+		ch:   make(chan Pub, opts.PubQueueSize),
+		drop: drop && opts.DropOnFull,
+	}
+	go func() {
+		for p := range q.ch {
+			PubCh <- p
+		}
+	}()
+	return q
+}
+
+// handle decodes the given publish and pushes it onto the queue
+func (q *pubQueue) handle(b []byte) error {
+	var p Pub
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&pubStats.Received, 1)
+	if !q.drop {
+		q.ch <- p
+		return nil
+	}
+
+	select {
+	case q.ch <- p:
+	default:
+		atomic.AddUint64(&pubStats.Dropped, 1)
+	}
+	return nil
+}
+
+// logPubStats periodically logs a warning if any publishes have been dropped
+func logPubStats(interval time.Duration) {
+	var lastDropped uint64
+	for range time.Tick(interval) {
+		stats := GetPubStats()
+		if stats.Dropped == lastDropped {
+			continue
+		}
+		llog.Warn("publishes dropped due to full queue", llog.KV{
+			"dropped":      stats.Dropped - lastDropped,
+			"totalDropped": stats.Dropped,
+			"received":     stats.Received,
+			"interval":     interval,
+		})
+		lastDropped = stats.Dropped
+	}
+}
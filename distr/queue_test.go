@@ -0,0 +1,38 @@
+package distr
+
+import (
+	"encoding/json"
+	. "testing"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubQueueDrop(t *T) {
+	// Not using newPubQueue so nothing is reading from the queue
+	q := &pubQueue{ch: make(chan Pub, 1), drop: true}
+	p := Pub{
+		Type:    "pub",
+		Conn:    conn.New(),
+		Channel: testutil.RandStr(),
+	}
+	b, err := json.Marshal(p)
+	require.Nil(t, err)
+
+	before := GetPubStats()
+	require.Nil(t, q.handle(b))
+	require.Nil(t, q.handle(b))
+	after := GetPubStats()
+
+	assert.Equal(t, before.Received+2, after.Received)
+	assert.Equal(t, before.Dropped+1, after.Dropped)
+	assert.Equal(t, p, <-q.ch)
+}
+
+func TestPubQueueSizeDefault(t *T) {
+	// the tests' Init doesn't set PubQueueSize
+	assert.Equal(t, DefaultPubQueueSize, opts.PubQueueSize)
+	assert.Equal(t, DefaultPubQueueSize, cap(newPubQueue(true).ch))
+}
@@ -0,0 +1,244 @@
+package distr
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/mediocregopher/radix.v2/sentinel"
+	"github.com/mediocregopher/radix.v2/util"
+)
+
+// Opts describes how to connect to redis
+type Opts struct {
+	// Address of the redis node to connect to. If the node is in a cluster the
+	// rest of the cluster will be discovered automatically. If SentinelMaster
+	// is set this is the address of a sentinel instead.
+	Addr string
+
+	// If set, the sentinel at Addr is asked for the current master of this
+	// name, and all connections are made to that master
+	SentinelMaster string
+
+	// If Password is set it is sent with AUTH on every new redis connection.
+	// User only needs to be set if redis ACLs are being used.
+	User, Password string
+
+	// If not zero, this database is selected on every new redis connection.
+	// Redis cluster only supports database 0.
+	DB int
+
+	// If set, all connections (including to the sentinel) are made over TLS
+	// using this config
+	TLSConfig *tls.Config
+
+	// Number of connections to make per-redis instance
+	PoolSize int
+
+	// Number of connections to make to subscribe to publishes being broadcast
+	// across the cluster. Must be consistent across all otter nodes
+	NumSubConns int
+
+	// If set, sharded pubsub (SPUBLISH/SSUBSCRIBE) is used instead of normal
+	// pubsub, so that in a cluster each publish is only sent to the node
+	// owning its sub key rather than to every node. Requires redis 7 or above,
+	// and must be consistent across all otter nodes.
+	ShardedPubSub bool
+
+	// If not zero, interest mode is used. Channels are hashed into this many
+	// buckets, and nodes only receive publishes for buckets which their local
+	// connections are subscribed to, rather than receiving every publish. A
+	// higher number means less unwanted traffic, but more subscribing and
+	// unsubscribing. ShardedPubSub has no effect in interest mode. Must be
+	// consistent across all otter nodes.
+	InterestBuckets int
+
+	// If set, publishes are sent using redis streams instead of pubsub. Nodes
+	// keep track of what they've read, so publishes made while a node is
+	// reconnecting aren't lost. ShardedPubSub and InterestBuckets have no
+	// effect in streams mode. Requires redis 5 or above, and must be
+	// consistent across all otter nodes.
+	Streams bool
+
+	// Approximate number of publishes kept in each stream in streams mode,
+	// which limits how far behind a node can fall before it starts missing
+	// publishes. If zero streams are not trimmed at all.
+	StreamMaxLen int
+
+	// Size of the queue which sits between each connection receiving
+	// publishes from redis and PubCh. Defaults to DefaultPubQueueSize.
+	PubQueueSize int
+
+	// If set, publishes received while their connection's queue is full are
+	// dropped rather than blocking the connection until there's room. Dropped
+	// publishes are counted in PubStats. Has no effect in streams mode.
+	DropOnFull bool
+}
+
+// DefaultPubQueueSize is used for Opts.PubQueueSize if it isn't set
+const DefaultPubQueueSize = 1000
+
+var opts Opts
+
+func dialConn(network, addr string) (*redis.Client, error) {
+	if opts.TLSConfig == nil {
+		return redis.Dial(network, addr)
+	}
+
+	nc, err := tls.Dial(network, addr, opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	c, err := redis.NewClient(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial is a pool.DialFunc which sets up new connections according to opts
+func dial(network, addr string) (*redis.Client, error) {
+	c, err := dialConn(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Password != "" {
+		args := []interface{}{opts.Password}
+		if opts.User != "" {
+			args = []interface{}{opts.User, opts.Password}
+		}
+		if err := c.Cmd("AUTH", args...).Err; err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if opts.DB != 0 {
+		if err := c.Cmd("SELECT", opts.DB).Err; err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// sentinelCmder wraps a sentinel client so it can be used as a util.Cmder, with
+// all commands going to the current master
+type sentinelCmder struct {
+	*sentinel.Client
+	name string
+}
+
+func (sc sentinelCmder) Get() (*redis.Client, error) {
+	return sc.GetMaster(sc.name)
+}
+
+func (sc sentinelCmder) Put(c *redis.Client) {
+	sc.PutMaster(sc.name, c)
+}
+
+func (sc sentinelCmder) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	c, err := sc.Get()
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer sc.Put(c)
+	return c.Cmd(cmd, args...)
+}
+
+func dialCmder() (util.Cmder, error) {
+	if opts.SentinelMaster != "" {
+		sc, err := sentinel.NewClientCustom("tcp", opts.Addr, opts.PoolSize, dial, opts.SentinelMaster)
+		if err != nil {
+			return nil, err
+		}
+		return sentinelCmder{Client: sc, name: opts.SentinelMaster}, nil
+	}
+
+	c, err := dial("tcp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.Cmd("INFO", "cluster").Str()
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(info, "cluster_enabled:1") {
+		cl, err := cluster.NewWithOpts(cluster.Opts{
+			Addr:     opts.Addr,
+			PoolSize: opts.PoolSize,
+			Dialer:   dial,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cl, nil
+	}
+
+	p, err := pool.NewCustom("tcp", opts.Addr, opts.PoolSize, dial)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// subAddr returns the address which the sub connection for the given key should
+// be made to. If a sentinel is being used this will be the address of the
+// current master. If a cluster is being used it will be the address of the node
+// which owns the key's slot, so that sub connections are spread across the
+// cluster.
+func subAddr(key string) (string, error) {
+	switch ct := cmder.(type) {
+	case *cluster.Cluster:
+		c, err := ct.GetForKey(key)
+		if err != nil {
+			return "", err
+		}
+		ct.Put(c)
+		return c.Addr, nil
+
+	case sentinelCmder:
+		return sentinelMasterAddr()
+	}
+
+	return opts.Addr, nil
+}
+
+func sentinelMasterAddr() (string, error) {
+	c, err := dialConn("tcp", opts.Addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	l, err := c.Cmd("SENTINEL", "get-master-addr-by-name", opts.SentinelMaster).List()
+	if err != nil {
+		return "", err
+	} else if len(l) != 2 {
+		return "", errors.New("sentinel does not know about master")
+	}
+	return net.JoinHostPort(l[0], l[1]), nil
+}
+
+// resetTopology causes the cluster's topology to be reloaded, if a cluster is
+// being used. It is called when a sub connection fails, since that may be
+// because of a node going away.
+func resetTopology() {
+	cl, ok := cmder.(*cluster.Cluster)
+	if !ok {
+		return
+	}
+	if err := cl.Reset(); err != nil {
+		llog.Error("error resetting cluster topology", llog.KV{"err": err})
+	}
+}
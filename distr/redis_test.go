@@ -0,0 +1,28 @@
+package distr
+
+import (
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDial(t *T) {
+	oldOpts := opts
+	defer func() { opts = oldOpts }()
+
+	opts.DB = 1
+	c, err := dial("tcp", opts.Addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	// CLIENT LIST includes the db the connection is currently using
+	l, err := c.Cmd("CLIENT", "LIST").Str()
+	require.Nil(t, err)
+	assert.Contains(t, l, "db=1 ")
+
+	// Password is set but redis doesn't have one, so AUTH should fail
+	opts.Password = "foo"
+	_, err = dial("tcp", opts.Addr)
+	assert.NotNil(t, err)
+}
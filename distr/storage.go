@@ -0,0 +1,45 @@
+package distr
+
+import (
+	"time"
+
+	"github.com/levenlabs/otter/conn"
+)
+
+// storage is where distr keeps all of its data and sends publishes through.
+// Each exported function which touches data is a thin wrapper around one of
+// its methods, see those for what each does. Init uses redisStore, which is
+// the default, while InitMemory uses a memStore.
+type storage interface {
+	subscribe(c conn.Conn, channels []string) error
+	unsubscribe(c conn.Conn, channels []string) error
+	updateConn(old, new conn.Conn, channels []string) error
+	getSubscribed(nodeID, channel string, backend bool) ([]conn.Conn, error)
+	getSubscribedPage(nodeID, channel string, backend bool, offset, count int) ([]conn.Conn, error)
+	subscribedTo(nodeID string, cc []conn.Conn, channels []string) ([][]bool, error)
+	countSubscribed(nodeID, channel string, backend bool) (int, error)
+	getSubscribedPresences(nodeID, channel string) ([]string, error)
+	getChannelCounts(nodeID string, backend bool, prefix string) (map[string]int, error)
+	cleanChannels(backend bool)
+
+	addConnInfo(ci ConnInfo) error
+	removeConnInfo(c conn.Conn) error
+	getConnInfo(id conn.ID) (ConnInfo, bool, error)
+	getConnInfosByPresence(nodeID, presenceKey string) ([]ConnInfo, error)
+
+	addHistory(p Pub, size int) error
+	getHistory(channel string) ([]Pub, error)
+
+	heartbeat() (bool, error)
+	getNodeIDs(timeout time.Duration) ([]string, error)
+	cleanDeadNodes(timeout time.Duration)
+
+	// publish sends the given Pub to every node, to be written to their PubCh
+	publish(p Pub) error
+}
+
+// redisStore keeps data in, and sends publishes through, the redis instance
+// which cmder is connected to
+type redisStore struct{}
+
+var store storage = redisStore{}
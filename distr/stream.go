@@ -0,0 +1,174 @@
+package distr
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// In streams mode (see Opts.Streams) publishes are added to one of NumSubConns
+// redis streams rather than being PUBLISH'd. Every node reads every stream,
+// keeping track of the last entry ID it has seen, so if a connection has to be
+// remade nothing published in the meantime is missed.
+
+const (
+	streamReadCount = 100
+	streamBlock     = 5 * time.Second
+)
+
+func streamKey(i int) string {
+	return fmt.Sprintf("stream:%d", i)
+}
+
+func spinStream(i int) {
+	key := streamKey(i)
+	var lastID string
+	// Blocking here is fine, redis doesn't push anything to stream readers so
+	// it can't back up. Dropping would defeat the point of streams anyway.
+	q := newPubQueue(false)
+
+	for first := true; ; first = false {
+		if !first {
+			time.Sleep(1 * time.Second)
+		}
+
+		kv := llog.KV{"i": i}
+		addr, err := subAddr(key)
+		if err != nil {
+			kv["err"] = err
+			llog.Error("could not get address for stream connection", kv)
+			resetTopology()
+			continue
+		}
+		kv["addr"] = addr
+
+		llog.Info("starting stream connection", kv)
+		c, err := dial("tcp", addr)
+		if err != nil {
+			kv["err"] = err
+			llog.Error("could not start stream connection", kv)
+			resetTopology()
+			continue
+		}
+
+		// Only on the very first connection do we not know where to start
+		// from, in which case start from whatever is newest
+		if lastID == "" {
+			if lastID, err = streamLastID(c, key); err != nil {
+				c.Close()
+				kv["err"] = err
+				llog.Error("could not get last stream id", kv)
+				continue
+			}
+		}
+
+		err = readStream(c, key, &lastID, q)
+		c.Close()
+		kv["err"] = err
+		kv["lastID"] = lastID
+		llog.Error("stream connection closed", kv)
+		resetTopology()
+	}
+}
+
+func streamLastID(c *redis.Client, key string) (string, error) {
+	ee, err := c.Cmd("XREVRANGE", key, "+", "-", "COUNT", 1).Array()
+	if err != nil {
+		return "", err
+	} else if len(ee) == 0 {
+		return "0-0", nil
+	}
+
+	e, err := ee[0].Array()
+	if err != nil {
+		return "", err
+	} else if len(e) == 0 {
+		return "", errors.New("malformed stream entry")
+	}
+	return e[0].Str()
+}
+
+// readStream reads entries off of the stream at the given key, starting after
+// lastID, and pushes them onto the given queue. lastID is updated as entries are read,
+// so that reading can be resumed on a new connection without missing anything.
+func readStream(c *redis.Client, key string, lastID *string, q *pubQueue) error {
+	blockMS := int64(streamBlock / time.Millisecond)
+	for {
+		r := c.Cmd("XREAD", "COUNT", streamReadCount, "BLOCK", blockMS, "STREAMS", key, *lastID)
+		if r.Err != nil {
+			return r.Err
+		} else if r.IsType(redis.Nil) {
+			continue
+		}
+
+		// The response is an array of streams, each being its key and then
+		// an array of entries. We only ever read one stream.
+		ss, err := r.Array()
+		if err != nil {
+			return err
+		} else if len(ss) != 1 {
+			return errors.New("unexpected number of streams returned")
+		}
+		s, err := ss[0].Array()
+		if err != nil {
+			return err
+		} else if len(s) != 2 {
+			return errors.New("malformed stream")
+		}
+		ee, err := s[1].Array()
+		if err != nil {
+			return err
+		}
+
+		for _, er := range ee {
+			id, b, err := streamEntry(er)
+			if err != nil {
+				return err
+			}
+			// a bad entry would be read again on every reconnect, so it's
+			// skipped rather than causing one
+			if err := q.handle(b); err != nil {
+				llog.Error("error decoding pub from stream", llog.KV{
+					"key": key,
+					"id":  id,
+					"err": err,
+				})
+			}
+			*lastID = id
+		}
+	}
+}
+
+// streamEntry returns the ID and pub field of an entry returned from XREAD
+func streamEntry(er *redis.Resp) (string, []byte, error) {
+	e, err := er.Array()
+	if err != nil {
+		return "", nil, err
+	} else if len(e) != 2 {
+		return "", nil, errors.New("malformed stream entry")
+	}
+
+	id, err := e[0].Str()
+	if err != nil {
+		return "", nil, err
+	}
+
+	fields, err := e[1].Map()
+	if err != nil {
+		return "", nil, err
+	}
+	return id, []byte(fields["p"]), nil
+}
+
+func publishStream(b []byte) error {
+	args := []interface{}{streamKey(rand.Intn(numSubKeys))}
+	if opts.StreamMaxLen > 0 {
+		args = append(args, "MAXLEN", "~", opts.StreamMaxLen)
+	}
+	args = append(args, "*", "p", b)
+	return cmder.Cmd("XADD", args...).Err
+}
@@ -0,0 +1,47 @@
+package distr
+
+import (
+	"encoding/json"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadStream(t *T) {
+	key := testutil.RandStr()
+	c, err := dial("tcp", opts.Addr)
+	require.Nil(t, err)
+	defer c.Close()
+
+	lastID, err := streamLastID(c, key)
+	require.Nil(t, err)
+	assert.Equal(t, "0-0", lastID)
+
+	// Add the entries before reading starts, to simulate a node which was
+	// reconnecting while they were added
+	pp := make([]Pub, 3)
+	for i := range pp {
+		pp[i] = Pub{
+			Type:    "pub",
+			Conn:    conn.New(),
+			Channel: testutil.RandStr(),
+		}
+		b, err := json.Marshal(pp[i])
+		require.Nil(t, err)
+		require.Nil(t, cmder.Cmd("XADD", key, "*", "p", b).Err)
+	}
+
+	go readStream(c, key, &lastID, newPubQueue(false))
+	for _, p := range pp {
+		select {
+		case p2 := <-PubCh:
+			assert.Equal(t, p, p2)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timedout out waiting for publish")
+		}
+	}
+}
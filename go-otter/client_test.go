@@ -0,0 +1,241 @@
+package otter_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/distr"
+	"github.com/levenlabs/otter/go-otter"
+	"github.com/levenlabs/otter/ottertest"
+	"github.com/levenlabs/otter/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFor waits for the given condition to become true, failing the test if it
+// doesn't soon enough
+func waitFor(t *T, what string, cond func() bool) {
+	for deadline := time.Now().Add(1 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// countSubbed returns the number of client connections subscribed to the
+// channel on the ottertest servers
+func countSubbed(ch string) int {
+	n, _ := distr.CountSubscribed(conn.NodeID, ch, false)
+	return n
+}
+
+func requireRcv(t *T, pubCh <-chan otter.Pub) otter.Pub {
+	select {
+	case p := <-pubCh:
+		return p
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for pub")
+	}
+	return otter.Pub{}
+}
+
+func isCanceled(err error) bool {
+	uerr, ok := err.(*url.Error)
+	return ok && uerr.Err == context.Canceled
+}
+
+// proxy forwards tcp connections to an address, and can cut them all at once
+// to simulate a lost connection
+type proxy struct {
+	ln    net.Listener
+	l     sync.Mutex
+	conns []net.Conn
+}
+
+func newProxy(t *T, to string) *proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	p := &proxy{ln: ln}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", to)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			p.l.Lock()
+			p.conns = append(p.conns, c, up)
+			p.l.Unlock()
+			go io.Copy(up, c)
+			go io.Copy(c, up)
+		}
+	}()
+	return p
+}
+
+func (p *proxy) url() string {
+	return "http://" + p.ln.Addr().String()
+}
+
+func (p *proxy) cut() {
+	p.l.Lock()
+	defer p.l.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *proxy) close() {
+	p.ln.Close()
+	p.cut()
+}
+
+// deadURL returns a URL which nothing is listening on
+func deadURL(t *T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ln.Close()
+	return "http://" + ln.Addr().String()
+}
+
+// hangingListener accepts connections but never responds on them
+type hangingListener struct {
+	ln    net.Listener
+	l     sync.Mutex
+	conns []net.Conn
+}
+
+func newHangingListener(t *T) *hangingListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	h := &hangingListener{ln: ln}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h.l.Lock()
+			h.conns = append(h.conns, c)
+			h.l.Unlock()
+		}
+	}()
+	return h
+}
+
+func (h *hangingListener) url() string {
+	return "http://" + h.ln.Addr().String()
+}
+
+func (h *hangingListener) accepted() int {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return len(h.conns)
+}
+
+func (h *hangingListener) close() {
+	h.ln.Close()
+	h.l.Lock()
+	defer h.l.Unlock()
+	for _, c := range h.conns {
+		c.Close()
+	}
+}
+
+func TestSubscribeContext(t *T) {
+	srv := ottertest.NewServer()
+	defer srv.Close()
+	ch := testutil.RandStr()
+	c := srv.Client(testutil.RandStr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := c.SubscribeContext(ctx, make(chan otter.Pub), ch)
+	waitFor(t, "subscription", func() bool { return countSubbed(ch) == 1 })
+	cancel()
+	select {
+	case err, ok := <-errCh:
+		assert.False(t, ok, "err:%v", err)
+	case <-time.After(1 * time.Second):
+		t.Fatal("subscription wasn't closed")
+	}
+	waitFor(t, "unsubscribe", func() bool { return countSubbed(ch) == 0 })
+
+	// the context also applies to the websocket handshake
+	ln := newHangingListener(t)
+	defer ln.close()
+	c.URLs = []string{ln.url()}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	select {
+	case err := <-c.SubscribeContext(ctx, make(chan otter.Pub), ch):
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(1 * time.Second):
+		t.Fatal("handshake wasn't interrupted")
+	}
+}
+
+func TestRequestContext(t *T) {
+	srv := ottertest.NewServer()
+	defer srv.Close()
+	ch := testutil.RandStr()
+	backend := srv.BackendClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := backend.PublishContext(ctx, "foo", ch)
+	assert.True(t, isCanceled(err), "err:%v", err)
+	_, err = backend.GetSubscribedContext(ctx, ch)
+	assert.True(t, isCanceled(err), "err:%v", err)
+	_, err = backend.CountSubscribedContext(ctx, ch)
+	assert.True(t, isCanceled(err), "err:%v", err)
+}
+
+func TestTLS(t *T) {
+	srv := ottertest.NewServer()
+	defer srv.Close()
+	ch := testutil.RandStr()
+	tlsSrv := httptest.NewTLSServer(ws.NewHandler())
+	defer tlsSrv.Close()
+
+	useTLS := func(c otter.Client) otter.Client {
+		c.URLs = []string{tlsSrv.URL}
+		c.HTTPClient = tlsSrv.Client()
+		c.TLSConfig = tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig
+		return c
+	}
+	client := useTLS(srv.Client(testutil.RandStr()))
+	backend := useTLS(srv.BackendClient())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	pubCh := make(chan otter.Pub, 1)
+	client.Subscribe(pubCh, stopCh, ch)
+	waitFor(t, "subscription", func() bool { return countSubbed(ch) == 1 })
+	require.Nil(t, backend.Publish("foo", ch))
+	assert.Equal(t, "pub", requireRcv(t, pubCh).Type)
+
+	// the server's certificate can't be verified without its TLSConfig
+	client.TLSConfig = nil
+	select {
+	case err := <-client.Subscribe(pubCh, stopCh, ch):
+		assert.NotNil(t, err)
+	case <-time.After(1 * time.Second):
+		t.Fatal("subscription wasn't refused")
+	}
+}
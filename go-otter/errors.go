@@ -0,0 +1,61 @@
+package otter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/levenlabs/otter/ws"
+)
+
+// HTTPError is returned from Client's methods which make http requests when
+// otter responds with an error
+type HTTPError struct {
+	StatusCode int
+
+	// The error message otter returned
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("otter responded %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary returns true if the error was caused by otter failing to do
+// something it should have been able to, like talk to redis, in which case the
+// request may succeed if it is retried. Errors caused by the request itself,
+// like an invalid signature, are not temporary.
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode >= 500
+}
+
+// InvalidSignature returns true if the request was rejected because the
+// presence signature given by the Client's PresenceFunc was invalid
+func (e *HTTPError) InvalidSignature() bool {
+	return e.StatusCode == http.StatusBadRequest && e.Message == ws.ErrInvalidSig.Error()
+}
+
+// Forbidden returns true if the request was rejected because the Client isn't
+// allowed to make it, e.g. GetSubscribed by a non-backend Client
+func (e *HTTPError) Forbidden() bool {
+	return e.StatusCode == http.StatusForbidden
+}
+
+// checkResp returns an *HTTPError if the response doesn't have a 2xx status. In
+// all cases the body is read to completion, but not closed.
+func checkResp(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	// otter's error messages are short, no need to read a giant body if
+	// something else has gone wrong
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	io.Copy(ioutil.Discard, resp.Body)
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(b)),
+	}
+}
@@ -0,0 +1,119 @@
+package otter
+
+import "encoding/json"
+
+// Handlers dispatches Pubs to a different callback depending on their Type,
+// decoding the messages of "pub" Pubs into the value returned by NewMsg. Any
+// callback may be left nil, in which case Pubs of that type are ignored.
+//
+//	h := otter.Handlers{
+//		NewMsg: func() interface{} { return new(MyMsg) },
+//		OnPub: func(p otter.Pub, msg interface{}) {
+//			log.Printf("got msg: %#v", msg.(*MyMsg))
+//		},
+//	}
+type Handlers struct {
+	// Returns a pointer to a new value for the message of a "pub" to be
+	// decoded into. If nil, messages are decoded into an interface{} the same
+	// way as json.Unmarshal would.
+	NewMsg func() interface{}
+
+	// Called for every "pub" whose message was successfully decoded, with the
+	// value returned by NewMsg. If the "pub" had no message the value is left
+	// as NewMsg returned it.
+	OnPub func(p Pub, msg interface{})
+
+	// Called whenever a client subscribes to a channel. Only backend
+	// applications receive these.
+	OnSub func(p Pub)
+
+	// Called whenever a client unsubscribes from a channel. Only backend
+	// applications receive these.
+	OnUnsub func(p Pub)
+
+	// Called whenever a client changes its presence, with its new presence in
+	// p.Conn. One is received for each channel the client is subscribed to.
+	// Only backend applications receive these.
+	OnPresence func(p Pub)
+
+	// Called for every "pub" whose message could not be decoded. A decode
+	// error does not affect the subscription it happened on.
+	OnDecodeError func(p Pub, err error)
+}
+
+// decode decodes the Pub's message according to NewMsg
+func (h Handlers) decode(p Pub) (interface{}, error) {
+	if h.NewMsg != nil {
+		msg := h.NewMsg()
+		if p.Message == nil {
+			return msg, nil
+		}
+		return msg, json.Unmarshal(*p.Message, msg)
+	}
+
+	var msg interface{}
+	if p.Message == nil {
+		return msg, nil
+	}
+	err := json.Unmarshal(*p.Message, &msg)
+	return msg, err
+}
+
+// Handle calls the appropriate callback for the given Pub
+func (h Handlers) Handle(p Pub) {
+	switch p.Type {
+	case "pub":
+		msg, err := h.decode(p)
+		if err != nil {
+			if h.OnDecodeError != nil {
+				h.OnDecodeError(p, err)
+			}
+			return
+		}
+		if h.OnPub != nil {
+			h.OnPub(p, msg)
+		}
+	case "sub":
+		if h.OnSub != nil {
+			h.OnSub(p)
+		}
+	case "unsub":
+		if h.OnUnsub != nil {
+			h.OnUnsub(p)
+		}
+	case "presence":
+		if h.OnPresence != nil {
+			h.OnPresence(p)
+		}
+	}
+}
+
+// Dispatch calls Handle for every Pub read off of pubCh, until pubCh is closed
+func (h Handlers) Dispatch(pubCh <-chan Pub) {
+	for p := range pubCh {
+		h.Handle(p)
+	}
+}
+
+// SubscribeHandlers is like NewSubscription, but rather than writing Pubs to a
+// channel it passes them to the given Handlers. The callbacks are all called
+// from a single go-routine, and are not called anymore once Close on the
+// returned Subscription has returned. Since Close waits for any callback which
+// is running to return, Close must not be called from within one.
+func (c Client) SubscribeHandlers(h Handlers, o SubscriptionOpts, subs ...string) *Subscription {
+	pubCh := make(chan Pub)
+	s := c.NewSubscription(pubCh, o, subs...)
+	s.handlersDoneCh = make(chan struct{})
+	go func() {
+		defer close(s.handlersDoneCh)
+		for {
+			select {
+			case p := <-pubCh:
+				h.Handle(p)
+			case <-s.doneCh:
+				return
+			}
+		}
+	}()
+	return s
+}
@@ -0,0 +1,93 @@
+package otter
+
+import (
+	"encoding/json"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testMsg struct {
+	Foo string `json:"foo"`
+}
+
+// testHandlers returns Handlers which record which callbacks were called, and
+// with what, into the returned slice
+func testHandlers() (Handlers, *[]string, *[]testMsg) {
+	var called []string
+	var msgs []testMsg
+	h := Handlers{
+		NewMsg: func() interface{} { return new(testMsg) },
+		OnPub: func(p Pub, msg interface{}) {
+			called = append(called, "pub")
+			msgs = append(msgs, *msg.(*testMsg))
+		},
+		OnSub:      func(p Pub) { called = append(called, "sub") },
+		OnUnsub:    func(p Pub) { called = append(called, "unsub") },
+		OnPresence: func(p Pub) { called = append(called, "presence") },
+		OnDecodeError: func(p Pub, err error) {
+			if err != nil {
+				called = append(called, "decodeError")
+			}
+		},
+	}
+	return h, &called, &msgs
+}
+
+func rawMsg(s string) *json.RawMessage {
+	m := json.RawMessage(s)
+	return &m
+}
+
+func TestHandle(t *T) {
+	h, called, msgs := testHandlers()
+	for _, p := range []Pub{
+		{Type: "pub", Message: rawMsg(`{"foo":"bar"}`)},
+		{Type: "pub"},
+		{Type: "pub", Message: rawMsg(`"not an object"`)},
+		{Type: "sub"},
+		{Type: "unsub"},
+		{Type: "presence"},
+		{Type: "unknown"},
+	} {
+		h.Handle(p)
+	}
+
+	assert.Equal(t, []string{"pub", "pub", "decodeError", "sub", "unsub", "presence"}, *called)
+	assert.Equal(t, []testMsg{{Foo: "bar"}, {}}, *msgs)
+}
+
+func TestHandleNil(t *T) {
+	// none of these should panic
+	var h Handlers
+	for _, p := range []Pub{
+		{Type: "pub", Message: rawMsg(`{"foo":"bar"}`)},
+		{Type: "pub", Message: rawMsg(`"not an object"`)},
+		{Type: "sub"},
+		{Type: "unsub"},
+		{Type: "presence"},
+	} {
+		h.Handle(p)
+	}
+}
+
+func TestHandleNoNewMsg(t *T) {
+	var msgs []interface{}
+	h := Handlers{
+		OnPub: func(p Pub, msg interface{}) { msgs = append(msgs, msg) },
+	}
+	h.Handle(Pub{Type: "pub", Message: rawMsg(`{"foo":"bar"}`)})
+	h.Handle(Pub{Type: "pub", Message: rawMsg(`1`)})
+	h.Handle(Pub{Type: "pub"})
+	assert.Equal(t, []interface{}{map[string]interface{}{"foo": "bar"}, float64(1), nil}, msgs)
+}
+
+func TestDispatch(t *T) {
+	h, called, _ := testHandlers()
+	pubCh := make(chan Pub, 2)
+	pubCh <- Pub{Type: "sub"}
+	pubCh <- Pub{Type: "unsub"}
+	close(pubCh)
+	h.Dispatch(pubCh)
+	assert.Equal(t, []string{"sub", "unsub"}, *called)
+}
@@ -14,11 +14,20 @@
 //	}()
 //
 //	for {
-//		err := c.Subscribe(pubCh, nil, "someChannel")
+//		err := <-c.Subscribe(pubCh, nil, "someChannel")
 //		log.Printf("got error subscribing: %s", err)
 //		log.Printf("reconnecting")
 //	}
 //
+// Reconnecting is also handled by NewSubscription
+//
+//	sub := c.NewSubscription(pubCh, otter.SubscriptionOpts{
+//		OnDisconnect: func(err error) {
+//			log.Printf("disconnected, will reconnect: %s", err)
+//		},
+//	}, "someChannel")
+//	defer sub.Close()
+//
 // Backend application client
 //
 //	c := otter.Client{
@@ -30,9 +39,14 @@ package otter
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -53,13 +67,27 @@ type Client struct {
 	// URLs of otter instances. These will be picked from randomly when making
 	// connections to otter. This field should not be changed while there are
 	// active connections. A URL should consist of a hostname, path, and
-	// scheme.
+	// scheme. If the scheme is https or wss all connections to that URL will
+	// use TLS.
 	URLs []string
 
 	// Used to generate presence strings for connections made by this client.
 	// This function will be called on every new connection made. If nil, no
 	// presence information is ever used
 	PresenceFunc
+
+	// Used to make all http requests to otter. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+
+	// Used to make all websocket connections to otter. If nil, a zero
+	// net.Dialer is used.
+	Dialer *net.Dialer
+
+	// Used for websocket connections made to https or wss URLs. If nil, a zero
+	// tls.Config is used. The TLS config for http requests is set on
+	// HTTPClient's Transport instead.
+	TLSConfig *tls.Config
 }
 
 // Pub describes a publish message being received over a subscription connection
@@ -81,7 +109,24 @@ func BackendPresence(secret string) PresenceFunc {
 }
 
 func (c Client) randURL(scheme, suffix string, subs ...string) (*url.URL, error) {
-	u := c.URLs[rand.Intn(len(c.URLs))]
+	return c.makeURL(c.URLs[rand.Intn(len(c.URLs))], scheme, suffix, subs...)
+}
+
+// pickURL returns a random one of URLs, avoiding the given one if possible
+func (c Client) pickURL(avoid string) string {
+	candidates := make([]string, 0, len(c.URLs))
+	for _, u := range c.URLs {
+		if u != avoid {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return avoid
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (c Client) makeURL(u, scheme, suffix string, subs ...string) (*url.URL, error) {
 	// we have to parse here so we can get the host out and update it
 	uu, err := url.Parse(u)
 	if err != nil {
@@ -99,7 +144,12 @@ func (c Client) randURL(scheme, suffix string, subs ...string) (*url.URL, error)
 		}
 	}
 
+	// scheme is always the insecure one, the URL decides whether to use TLS
+	secure := uu.Scheme == "https" || uu.Scheme == "wss"
 	uu.Scheme = scheme
+	if secure {
+		uu.Scheme += "s"
+	}
 	uu.Path = path.Join(uu.Path, strings.Join(subs, ","))
 	if suffix != "" {
 		uu.Path = path.Join(uu.Path, suffix)
@@ -113,6 +163,86 @@ func (c Client) randURL(scheme, suffix string, subs ...string) (*url.URL, error)
 	return uu, nil
 }
 
+func (c Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// dialWS makes a websocket connection to the given URL, using TLS if its scheme
+// is wss. The context applies to the dial and to the TLS and websocket
+// handshakes.
+func (c Client) dialWS(ctx context.Context, u *url.URL) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(u.String(), u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	secure := u.Scheme == "wss"
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	d := c.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	nc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshakes don't take a context, so the conn is closed out from
+	// under them if the context is done first
+	handshakeDoneCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-handshakeDoneCh:
+		}
+	}()
+	conn, err := c.handshakeWS(config, nc, u)
+	close(handshakeDoneCh)
+	if ctx.Err() != nil {
+		if err == nil {
+			conn.Close()
+		}
+		err = ctx.Err()
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshakeWS does the TLS handshake over nc, if the URL calls for it, and then
+// the websocket one
+func (c Client) handshakeWS(config *websocket.Config, nc net.Conn, u *url.URL) (*websocket.Conn, error) {
+	if u.Scheme == "wss" {
+		tc := c.TLSConfig.Clone()
+		if tc == nil {
+			tc = &tls.Config{}
+		}
+		if tc.ServerName == "" {
+			tc.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(nc, tc)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		nc = tlsConn
+	}
+	return websocket.NewClient(config, nc)
+}
+
 // Subscribe is used to create a single otter connection which will listen for
 // incoming publishes from the given set of subscriptions. The publishes will be
 // pushed to the given channel.
@@ -124,6 +254,17 @@ func (c Client) randURL(scheme, suffix string, subs ...string) (*url.URL, error)
 // the subsription connection. The returned error channel will be closed in this
 // case.
 func (c Client) Subscribe(pubCh chan<- Pub, stopCh chan struct{}, subs ...string) <-chan error {
+	return c.subscribe(context.Background(), pubCh, stopCh, subs...)
+}
+
+// SubscribeContext is like Subscribe, but the connection is closed when the
+// given context is done, rather than when a stopCh is closed. The context
+// also applies to making the connection.
+func (c Client) SubscribeContext(ctx context.Context, pubCh chan<- Pub, subs ...string) <-chan error {
+	return c.subscribe(ctx, pubCh, nil, subs...)
+}
+
+func (c Client) subscribe(ctx context.Context, pubCh chan<- Pub, stopCh chan struct{}, subs ...string) <-chan error {
 	errCh := make(chan error, 1)
 
 	u, err := c.randURL("ws", "", subs...)
@@ -132,16 +273,25 @@ func (c Client) Subscribe(pubCh chan<- Pub, stopCh chan struct{}, subs ...string
 		return errCh
 	}
 
-	conn, err := websocket.Dial(u.String(), "", u.String())
+	conn, err := c.dialWS(ctx, u)
 	if err != nil {
 		errCh <- err
 		return errCh
 	}
 
+	return readSub(conn, pubCh, stopCh, ctx.Done())
+}
+
+// readSub reads publishes off of the given connection and writes them to pubCh,
+// with the same error semantics as Subscribe. The connection is closed when
+// either stopCh or doneCh is closed.
+func readSub(conn *websocket.Conn, pubCh chan<- Pub, stopCh, doneCh <-chan struct{}) <-chan error {
+	errCh := make(chan error, 1)
 	innerStopCh := make(chan struct{})
 	go func() {
 		select {
 		case <-stopCh:
+		case <-doneCh:
 		case <-innerStopCh:
 		}
 		conn.Close()
@@ -151,22 +301,40 @@ func (c Client) Subscribe(pubCh chan<- Pub, stopCh chan struct{}, subs ...string
 		defer close(innerStopCh)
 		defer close(errCh)
 
-		var p Pub
 		for {
-			err = websocket.JSON.Receive(conn, &p)
+			// a new Pub each time, otherwise the Message of the previous one
+			// would get overwritten
+			var p Pub
+			err := websocket.JSON.Receive(conn, &p)
 			if err != nil {
-				errCh <- err
+				// if the conn was closed on purpose errCh is just closed
+				select {
+				case <-stopCh:
+				case <-doneCh:
+				default:
+					errCh <- err
+				}
 				return
 			}
-			pubCh <- p
+			select {
+			case pubCh <- p:
+			case <-stopCh:
+			case <-doneCh:
+			}
 		}
 	}()
 
 	return errCh
 }
 
-// Publish will publish the given message to all the subs
+// Publish will publish the given message to all the subs. If otter responds
+// with an error it will be returned as an *HTTPError.
 func (c Client) Publish(msg interface{}, subs ...string) error {
+	return c.PublishContext(context.Background(), msg, subs...)
+}
+
+// PublishContext is like Publish, but the request is bound by the given context
+func (c Client) PublishContext(ctx context.Context, msg interface{}, subs ...string) error {
 	u, err := c.randURL("http", "", subs...)
 	if err != nil {
 		return err
@@ -182,20 +350,49 @@ func (c Client) Publish(msg interface{}, subs ...string) error {
 		return err
 	}
 
-	_, err = http.DefaultClient.Do(r)
+	resp, err := c.httpClient().Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResp(resp); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
 	return err
 }
 
 // GetSubscribed returns the union of all the connection objects currently
 // subscribed to the given subs. The Client *must* be a backend application in
-// order to use this.
+// order to use this. If otter responds with an error it will be returned as an
+// *HTTPError.
 func (c Client) GetSubscribed(subs ...string) ([]conn.Conn, error) {
-	u, err := c.randURL("http", "subbed", subs...)
-	if err != nil {
-		return nil, err
-	}
+	return c.GetSubscribedContext(context.Background(), subs...)
+}
+
+// GetSubscribedContext is like GetSubscribed, but the request is bound by the
+// given context
+func (c Client) GetSubscribedContext(ctx context.Context, subs ...string) ([]conn.Conn, error) {
+	return c.getSubscribed(ctx, nil, subs...)
+}
+
+// GetSubscribedFiltered is like GetSubscribed, but only connections whose
+// presence is a json object with all of the given fields are returned. Filter
+// keys are paths into the presence object, e.g. "user.id", and values are
+// compared to strings as-is and to anything else by its json encoding.
+func (c Client) GetSubscribedFiltered(filter map[string]string, subs ...string) ([]conn.Conn, error) {
+	return c.GetSubscribedFilteredContext(context.Background(), filter, subs...)
+}
+
+// GetSubscribedFilteredContext is like GetSubscribedFiltered, but the request
+// is bound by the given context
+func (c Client) GetSubscribedFilteredContext(ctx context.Context, filter map[string]string, subs ...string) ([]conn.Conn, error) {
+	return c.getSubscribed(ctx, filter, subs...)
+}
 
-	resp, err := http.Get(u.String())
+func (c Client) getSubscribed(ctx context.Context, filter map[string]string, subs ...string) ([]conn.Conn, error) {
+	resp, err := c.subbedRequest(ctx, filter, false, subs...)
 	if err != nil {
 		return nil, err
 	}
@@ -207,3 +404,232 @@ func (c Client) GetSubscribed(subs ...string) ([]conn.Conn, error) {
 	}
 	return res.Conns, nil
 }
+
+// StreamSubscribed is like GetSubscribedFiltered, but rather than all the
+// connections being returned at once they are streamed from otter, and fn is
+// called with each one (along with which of the subs it's subscribed to) as
+// it's received. This uses much less memory, on both ends, for subs with many
+// connections. A nil filter may be given. If fn returns an error the stream is
+// stopped and that error is returned. If the stream ends before otter has
+// indicated that it's complete io.ErrUnexpectedEOF is returned.
+func (c Client) StreamSubscribed(filter map[string]string, fn func(ws.SubListEntry) error, subs ...string) error {
+	return c.StreamSubscribedContext(context.Background(), filter, fn, subs...)
+}
+
+// StreamSubscribedContext is like StreamSubscribed, but the request is bound
+// by the given context
+func (c Client) StreamSubscribedContext(ctx context.Context, filter map[string]string, fn func(ws.SubListEntry) error, subs ...string) error {
+	resp, err := c.subbedRequest(ctx, filter, true, subs...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var e struct {
+			ws.SubListEntry
+			ws.StreamEnd
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&e); err != nil {
+			return err
+		} else if e.Error != "" {
+			return errors.New(e.Error)
+		} else if e.Done {
+			return nil
+		}
+		if err := fn(e.SubListEntry); err != nil {
+			return err
+		}
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func (c Client) subbedRequest(ctx context.Context, filter map[string]string, stream bool, subs ...string) (*http.Response, error) {
+	u, err := c.randURL("http", "subbed", subs...)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	for k, v := range filter {
+		q.Set("presence."+k, v)
+	}
+	if stream {
+		q.Set("stream", "true")
+	}
+	u.RawQuery = q.Encode()
+
+	r, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient().Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResp(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CountSubscribed returns the number of clients currently subscribed to each of
+// the given subs, keyed by sub. This is cheaper than GetSubscribed if only the
+// number is needed. The Client *must* be a backend application in order to use
+// this. If otter responds with an error it will be returned as an *HTTPError.
+func (c Client) CountSubscribed(subs ...string) (map[string]ws.SubCount, error) {
+	return c.CountSubscribedContext(context.Background(), subs...)
+}
+
+// CountSubscribedContext is like CountSubscribed, but the request is bound by
+// the given context
+func (c Client) CountSubscribedContext(ctx context.Context, subs ...string) (map[string]ws.SubCount, error) {
+	return c.countSubscribed(ctx, false, subs...)
+}
+
+// CountSubscribedPresences is like CountSubscribed, but the number of distinct
+// presences amongst the clients subscribed to each sub is also returned. This
+// is more expensive for otter to compute.
+func (c Client) CountSubscribedPresences(subs ...string) (map[string]ws.SubCount, error) {
+	return c.CountSubscribedPresencesContext(context.Background(), subs...)
+}
+
+// CountSubscribedPresencesContext is like CountSubscribedPresences, but the
+// request is bound by the given context
+func (c Client) CountSubscribedPresencesContext(ctx context.Context, subs ...string) (map[string]ws.SubCount, error) {
+	return c.countSubscribed(ctx, true, subs...)
+}
+
+func (c Client) countSubscribed(ctx context.Context, presences bool, subs ...string) (map[string]ws.SubCount, error) {
+	var q url.Values
+	if presences {
+		q = url.Values{"presences": {"true"}}
+	}
+	var res ws.SubCountRes
+	if err := c.getJSON(ctx, "count", q, &res, subs...); err != nil {
+		return nil, err
+	}
+	return res.Counts, nil
+}
+
+// GetChannels returns all channels which currently have clients subscribed to
+// them, along with the number of clients subscribed to each. If prefix is not
+// empty only channels starting with it are returned. The Client *must* be a
+// backend application in order to use this. If otter responds with an error it
+// will be returned as an *HTTPError.
+func (c Client) GetChannels(prefix string) (map[string]ws.SubCount, error) {
+	return c.GetChannelsContext(context.Background(), prefix)
+}
+
+// GetChannelsContext is like GetChannels, but the request is bound by the
+// given context
+func (c Client) GetChannelsContext(ctx context.Context, prefix string) (map[string]ws.SubCount, error) {
+	q := url.Values{}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	var res ws.SubCountRes
+	err := c.getAPIJSON(ctx, "channels", q, &res)
+	return res.Counts, err
+}
+
+// GetConn returns information about the connection with the given ID, or false
+// if there's no such connection. The Client *must* be a backend application in
+// order to use this. If otter responds with an error it will be returned as an
+// *HTTPError.
+func (c Client) GetConn(id conn.ID) (distr.ConnInfo, bool, error) {
+	return c.GetConnContext(context.Background(), id)
+}
+
+// GetConnContext is like GetConn, but the request is bound by the given context
+func (c Client) GetConnContext(ctx context.Context, id conn.ID) (distr.ConnInfo, bool, error) {
+	var ci distr.ConnInfo
+	err := c.getAPIJSON(ctx, "conn", url.Values{"id": {string(id)}}, &ci)
+	if herr, ok := err.(*HTTPError); ok && herr.StatusCode == http.StatusNotFound {
+		return ci, false, nil
+	}
+	return ci, err == nil, err
+}
+
+// FindConns returns information about all connections with the given presence
+// string. If the presence is a json object, connections whose presence is an
+// equivalent object are returned. The Client *must* be a backend application in
+// order to use this. If otter responds with an error it will be returned as an
+// *HTTPError.
+func (c Client) FindConns(presence string) ([]distr.ConnInfo, error) {
+	return c.FindConnsContext(context.Background(), presence)
+}
+
+// FindConnsContext is like FindConns, but the request is bound by the given
+// context
+func (c Client) FindConnsContext(ctx context.Context, presence string) ([]distr.ConnInfo, error) {
+	var res ws.ConnInfoListRes
+	err := c.getAPIJSON(ctx, "conns", url.Values{"withPresence": {presence}}, &res)
+	return res.Conns, err
+}
+
+// GetHistory returns the publishes recorded for each of the given channels,
+// keyed by channel and oldest first. Publishes are only recorded for channels
+// whose namespace has a history size, see the README. The Client must be
+// allowed to subscribe to all of the channels. If otter responds with an error
+// it will be returned as an *HTTPError.
+func (c Client) GetHistory(subs ...string) (map[string][]Pub, error) {
+	return c.GetHistoryContext(context.Background(), subs...)
+}
+
+// GetHistoryContext is like GetHistory, but the request is bound by the given
+// context
+func (c Client) GetHistoryContext(ctx context.Context, subs ...string) (map[string][]Pub, error) {
+	var res ws.HistoryRes
+	if err := c.getJSON(ctx, "history", nil, &res, subs...); err != nil {
+		return nil, err
+	}
+	m := make(map[string][]Pub, len(res.History))
+	for ch, pp := range res.History {
+		m[ch] = make([]Pub, len(pp))
+		for i := range pp {
+			m[ch][i] = Pub(pp[i])
+		}
+	}
+	return m, nil
+}
+
+// getAPIJSON is like getJSON, but for endpoints which aren't about particular
+// channels, see ws.APIPrefix
+func (c Client) getAPIJSON(ctx context.Context, endpoint string, query url.Values, into interface{}) error {
+	return c.getJSON(ctx, endpoint, query, into, ws.APIPrefix)
+}
+
+// getJSON makes a GET request to one of the endpoints for the given channels,
+// and decodes the json response into into
+func (c Client) getJSON(ctx context.Context, suffix string, query url.Values, into interface{}, subs ...string) error {
+	u, err := c.randURL("http", suffix, subs...)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	for k, vv := range query {
+		q[k] = vv
+	}
+	u.RawQuery = q.Encode()
+
+	r, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient().Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResp(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
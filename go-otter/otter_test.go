@@ -0,0 +1,89 @@
+package otter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPickURL(t *T) {
+	c := Client{URLs: []string{"http://a", "http://b", "http://c"}}
+	picked := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		u := c.pickURL("http://a")
+		assert.NotEqual(t, "http://a", u)
+		picked[u] = true
+	}
+	assert.Len(t, picked, 2)
+
+	// with only one URL there's no choice but to use the one being avoided
+	c = Client{URLs: []string{"http://a"}}
+	assert.Equal(t, "http://a", c.pickURL("http://a"))
+	c = Client{URLs: []string{"http://a", "http://a"}}
+	assert.Equal(t, "http://a", c.pickURL("http://a"))
+	c = Client{URLs: []string{"http://a", "http://a", "http://b"}}
+	assert.Equal(t, "http://b", c.pickURL("http://a"))
+}
+
+func TestMakeURL(t *T) {
+	ch := testutil.RandStr()
+	c := Client{PresenceFunc: BackendPresence(testutil.RandStr())}
+
+	assertURL := func(u, scheme, expected string) {
+		uu, err := c.makeURL(u, scheme, "", ch)
+		require.Nil(t, err)
+		q := uu.Query()
+		assert.Equal(t, "backend", q.Get("presence"))
+		assert.NotEmpty(t, q.Get("sig"))
+		uu.RawQuery = ""
+		assert.Equal(t, expected, uu.String())
+	}
+	assertURL("http://127.0.0.1/subs", "ws", "ws://127.0.0.1/subs/"+ch)
+	assertURL("http://127.0.0.1/subs", "http", "http://127.0.0.1/subs/"+ch)
+	assertURL("https://127.0.0.1/subs", "ws", "wss://127.0.0.1/subs/"+ch)
+	assertURL("wss://127.0.0.1:4444", "http", "https://127.0.0.1:4444/"+ch)
+	assertURL("ws://127.0.0.1", "http", "http://127.0.0.1/"+ch)
+
+	_, err := c.makeURL("127.0.0.1", "ws", "", ch)
+	assert.NotNil(t, err)
+}
+
+func TestStreamSubscribedEnd(t *T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	c := Client{URLs: []string{srv.URL}}
+
+	stream := func() ([]ws.SubListEntry, error) {
+		var ee []ws.SubListEntry
+		err := c.StreamSubscribed(nil, func(e ws.SubListEntry) error {
+			ee = append(ee, e)
+			return nil
+		}, "foo")
+		return ee, err
+	}
+
+	entry := `{"connection":{"id":"a"},"channels":["foo"]}` + "\n"
+	body = entry + entry + `{"done":true}` + "\n"
+	ee, err := stream()
+	assert.Nil(t, err)
+	assert.Len(t, ee, 2)
+
+	// a stream which is cut off between entries must not look successful
+	body = entry + entry
+	ee, err = stream()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Len(t, ee, 2)
+
+	body = entry + `{"error":"oh no"}` + "\n"
+	_, err = stream()
+	assert.EqualError(t, err, "oh no")
+}
@@ -0,0 +1,157 @@
+package otter
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/levenlabs/otter/backoff"
+)
+
+// SubscriptionOpts are optional parameters which can be given to
+// NewSubscription. All fields are optional.
+type SubscriptionOpts struct {
+	// Called whenever a connection is successfully made, with the URL (from
+	// the Client's URLs) it was made to
+	OnConnect func(url string)
+
+	// Called whenever a connection which had been made is lost, with the
+	// error which caused it
+	OnDisconnect func(err error)
+
+	// Called for every error encountered, including failed attempts at
+	// connecting. The Subscription will retry after all errors.
+	OnError func(err error)
+
+	// Minimum and maximum amount of time to wait between connection attempts.
+	// The wait time doubles after each failed attempt, and a random jitter is
+	// applied. Defaults to 100ms and 30s.
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// Subscription is a set of subscriptions which is remade whenever its
+// connection is lost, until Close is called. See NewSubscription.
+type Subscription struct {
+	c      Client
+	o      SubscriptionOpts
+	pubCh  chan<- Pub
+	subs   []string
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	// set by SubscribeHandlers, closed once its callbacks will no longer be
+	// called
+	handlersDoneCh chan struct{}
+}
+
+// NewSubscription is like Subscribe, except that if the connection is lost it
+// will be remade, after waiting a backoff time, until Close is called on the
+// returned Subscription. When a connection is remade a different one of the
+// Client's URLs is used if possible.
+//
+// Note that any publishes made while a connection is being remade will not be
+// received.
+func (c Client) NewSubscription(pubCh chan<- Pub, o SubscriptionOpts, subs ...string) *Subscription {
+	if o.MinBackoff == 0 {
+		o.MinBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+
+	s := &Subscription{
+		c:      c,
+		o:      o,
+		pubCh:  pubCh,
+		subs:   subs,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go s.spin()
+	return s
+}
+
+// Close closes the Subscription's connection and stops it from being remade.
+// It will block until everything has been cleaned up.
+func (s *Subscription) Close() {
+	close(s.stopCh)
+	<-s.doneCh
+	if s.handlersDoneCh != nil {
+		<-s.handlersDoneCh
+	}
+}
+
+func (s *Subscription) spin() {
+	defer close(s.doneCh)
+
+	var lastURL string
+	var attempts uint
+	for {
+		if attempts > 0 {
+			select {
+			case <-time.After(backoff.Duration(s.o.MinBackoff, s.o.MaxBackoff, attempts)):
+			case <-s.stopCh:
+				return
+			}
+		}
+
+		u := s.c.pickURL(lastURL)
+		lastURL = u
+		attempts++
+
+		conn, err := s.dial(u)
+		if err != nil {
+			s.onError(err)
+			continue
+		}
+
+		attempts = 0
+		if s.o.OnConnect != nil {
+			s.o.OnConnect(u)
+		}
+
+		err, ok := <-readSub(conn, s.pubCh, s.stopCh, nil)
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+		if !ok {
+			continue
+		}
+
+		s.onError(err)
+		if s.o.OnDisconnect != nil {
+			s.o.OnDisconnect(err)
+		}
+		// always wait at least a little before reconnecting, so a server
+		// which is immediately closing connections isn't hammered
+		attempts = 1
+	}
+}
+
+func (s *Subscription) dial(u string) (*websocket.Conn, error) {
+	uu, err := s.c.makeURL(u, "ws", "", s.subs...)
+	if err != nil {
+		return nil, err
+	}
+
+	// cancel the dial if the Subscription is closed while it's happening
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s.c.dialWS(ctx, uu)
+}
+
+func (s *Subscription) onError(err error) {
+	if s.o.OnError != nil {
+		s.o.OnError(err)
+	}
+}
@@ -0,0 +1,147 @@
+package otter_test
+
+import (
+	"encoding/json"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/go-otter"
+	"github.com/levenlabs/otter/ottertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// subEvents records the callbacks made by a Subscription
+type subEvents struct {
+	l           sync.Mutex
+	connects    []string
+	disconnects int
+	errs        int
+}
+
+func (ev *subEvents) opts() otter.SubscriptionOpts {
+	return otter.SubscriptionOpts{
+		OnConnect: func(u string) {
+			ev.l.Lock()
+			defer ev.l.Unlock()
+			ev.connects = append(ev.connects, u)
+		},
+		OnDisconnect: func(error) {
+			ev.l.Lock()
+			defer ev.l.Unlock()
+			ev.disconnects++
+		},
+		OnError: func(error) {
+			ev.l.Lock()
+			defer ev.l.Unlock()
+			ev.errs++
+		},
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+}
+
+func (ev *subEvents) get() ([]string, int, int) {
+	ev.l.Lock()
+	defer ev.l.Unlock()
+	return append([]string(nil), ev.connects...), ev.disconnects, ev.errs
+}
+
+func TestSubscriptionReconnect(t *T) {
+	srv := ottertest.NewServer()
+	defer srv.Close()
+	ch := testutil.RandStr()
+	p := newProxy(t, srv.Listener.Addr().String())
+	defer p.close()
+	c := srv.Client(testutil.RandStr())
+	c.URLs = []string{p.url()}
+
+	var ev subEvents
+	pubCh := make(chan otter.Pub, 10)
+	s := c.NewSubscription(pubCh, ev.opts(), ch)
+	defer s.Close()
+
+	assertPub := func(msg string) {
+		require.Nil(t, srv.BackendClient().Publish(msg, ch))
+		pub := requireRcv(t, pubCh)
+		assert.Equal(t, "pub", pub.Type)
+		var got string
+		require.Nil(t, json.Unmarshal(*pub.Message, &got))
+		assert.Equal(t, msg, got)
+	}
+
+	waitFor(t, "subscription", func() bool { return countSubbed(ch) == 1 })
+	connects, disconnects, _ := ev.get()
+	assert.Equal(t, []string{p.url()}, connects)
+	assert.Equal(t, 0, disconnects)
+	assertPub("foo")
+
+	p.cut()
+	waitFor(t, "reconnect", func() bool {
+		connects, disconnects, _ := ev.get()
+		return len(connects) == 2 && disconnects == 1
+	})
+	// the old connection is unsubscribed once otter notices it's gone
+	waitFor(t, "resubscription", func() bool { return countSubbed(ch) == 1 })
+	assertPub("bar")
+}
+
+func TestSubscriptionPickURL(t *T) {
+	srv := ottertest.NewServer()
+	defer srv.Close()
+	ch := testutil.RandStr()
+	c := srv.Client(testutil.RandStr())
+	c.URLs = []string{deadURL(t), srv.URL}
+
+	var ev subEvents
+	s := c.NewSubscription(make(chan otter.Pub, 10), ev.opts(), ch)
+	defer s.Close()
+
+	waitFor(t, "subscription", func() bool { return countSubbed(ch) == 1 })
+	connects, _, errs := ev.get()
+	assert.Equal(t, []string{srv.URL}, connects)
+	// a failed URL is never retried straight away when there's another one
+	assert.True(t, errs <= 1, "errs:%d", errs)
+}
+
+func TestSubscriptionClose(t *T) {
+	srv := ottertest.NewServer()
+	defer srv.Close()
+	ch := testutil.RandStr()
+	c := srv.Client(testutil.RandStr())
+
+	var ev subEvents
+	s := c.NewSubscription(make(chan otter.Pub), ev.opts(), ch)
+	waitFor(t, "subscription", func() bool { return countSubbed(ch) == 1 })
+	s.Close()
+	waitFor(t, "unsubscribe", func() bool { return countSubbed(ch) == 0 })
+	connects, disconnects, errs := ev.get()
+	assert.Len(t, connects, 1)
+	assert.Equal(t, 0, disconnects)
+	assert.Equal(t, 0, errs)
+
+	// Close must not wait out the backoff between attempts
+	c.URLs = []string{deadURL(t)}
+	o := ev.opts()
+	o.MinBackoff, o.MaxBackoff = 1*time.Hour, 1*time.Hour
+	s = c.NewSubscription(make(chan otter.Pub), o, ch)
+	waitFor(t, "failed attempt", func() bool {
+		_, _, errs := ev.get()
+		return errs == 1
+	})
+	start := time.Now()
+	s.Close()
+	assert.WithinDuration(t, start, time.Now(), 1*time.Second)
+
+	// nor a connection attempt which is hanging
+	ln := newHangingListener(t)
+	defer ln.close()
+	c.URLs = []string{ln.url()}
+	s = c.NewSubscription(make(chan otter.Pub), o, ch)
+	waitFor(t, "connection attempt", func() bool { return ln.accepted() > 0 })
+	start = time.Now()
+	s.Close()
+	assert.WithinDuration(t, start, time.Now(), 1*time.Second)
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/otter/authz"
 	"github.com/levenlabs/otter/conn"
 	"github.com/levenlabs/otter/distr"
+	"github.com/levenlabs/otter/namespace"
+	"github.com/levenlabs/otter/webhook"
 	"github.com/levenlabs/otter/ws"
 	"github.com/mediocregopher/lever"
 )
@@ -36,6 +43,37 @@ func main() {
 		Description: "Address of redis node to use. If node is in a cluster the rest o f the cluster will be discovered automatically",
 		Default:     "127.0.0.1:6379",
 	})
+	l.Add(lever.Param{
+		Name:        "--redis-sentinel-master",
+		Description: "If set, --redis-addr is treated as the address of a redis sentinel, and the master with this name is connected to",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-user",
+		Description: "User to authenticate to redis as. Only needed if redis ACLs are in use",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-password",
+		Description: "Password to authenticate to redis with. If not set no authentication is done",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-db",
+		Description: "Redis database to use. Must be 0 if redis is a cluster",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls",
+		Description: "If set, connections to redis are made over TLS",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls-ca-file",
+		Description: "PEM file of CA certificates to verify redis's certificate with. If not set the system's CAs are used",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-tls-skip-verify",
+		Description: "If set, redis's TLS certificate is not verified",
+		Flag:        true,
+	})
 	l.Add(lever.Param{
 		Name:        "--redis-pool-size",
 		Description: "Number of connections to make per-redis instance",
@@ -46,6 +84,91 @@ func main() {
 		Description: "Number of connections to make to subscribe to publishes being broadcast across the cluster. This number must be consistent across all otter nodes",
 		Default:     "10",
 	})
+	l.Add(lever.Param{
+		Name:        "--redis-sharded-pubsub",
+		Description: "If set, sharded pubsub is used to broadcast publishes, so that in a cluster they are spread across nodes rather than sent to all of them. Requires redis 7 or above. This must be consistent across all otter nodes",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-interest-buckets",
+		Description: "If not zero, channels are hashed into this many buckets and each node only receives publishes for buckets its connections are subscribed to, instead of receiving all publishes. This must be consistent across all otter nodes",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-streams",
+		Description: "If set, publishes are distributed using redis streams rather than pubsub, so that nodes which are reconnecting to redis don't miss any. Requires redis 5 or above. This must be consistent across all otter nodes",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--redis-stream-max-len",
+		Description: "Approximate number of publishes to keep in each stream when --redis-streams is set. Limits how far behind a node can fall before missing publishes. 0 means no limit",
+		Default:     "10000",
+	})
+	l.Add(lever.Param{
+		Name:        "--pub-queue-size",
+		Description: "Size of the queue of received publishes kept for each redis connection receiving them",
+		Default:     "1000",
+	})
+	l.Add(lever.Param{
+		Name:        "--drop-on-full",
+		Description: "If set, publishes received from redis while their queue is full are dropped, rather than reading from redis being paused until there's room. Pausing for too long can cause redis to disconnect otter",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook-url",
+		Description: "URL to POST connection lifecycle events (sub, unsub, presence, disconnect) to. May be specified more than once, each URL receives every event",
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook-secret",
+		Description: "Secret key to sign webhook bodies with. Required if --webhook-url is set, and must be different from --auth-secret",
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook-publishes",
+		Description: "If set, publishes made by clients are sent to --webhook-url as well",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook-queue-size",
+		Description: "Number of events which can be waiting to be delivered to each --webhook-url. Events are dropped for a URL while its queue is full",
+		Default:     "1000",
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook-max-attempts",
+		Description: "Number of times delivery of each event to a --webhook-url is attempted before giving up",
+		Default:     "5",
+	})
+	l.Add(lever.Param{
+		Name:        "--webhook-timeout",
+		Description: "Timeout for each attempt at delivering an event to a --webhook-url",
+		Default:     "5s",
+	})
+	l.Add(lever.Param{
+		Name:        "--authz-url",
+		Description: "If set, this URL is asked whether each client may subscribe or publish to each channel before it's allowed to. See the README for details",
+	})
+	l.Add(lever.Param{
+		Name:        "--authz-secret",
+		Description: "Secret key to sign requests to --authz-url with. Required if --authz-url is set, and must be different from --auth-secret",
+	})
+	l.Add(lever.Param{
+		Name:        "--authz-timeout",
+		Description: "Timeout for each request to --authz-url",
+		Default:     "2s",
+	})
+	l.Add(lever.Param{
+		Name:        "--authz-cache-ttl",
+		Description: "How long responses from --authz-url are remembered for, per presence and channel. 0 means they aren't",
+		Default:     "0s",
+	})
+	l.Add(lever.Param{
+		Name:        "--authz-fail-open",
+		Description: "If set, subscribes and publishes are allowed when a request to --authz-url fails, rather than being refused",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--namespaces",
+		Description: "json file defining per-channel options by channel name prefix. See the README for details",
+	})
 	l.Parse()
 
 	secret, _ := l.ParamStr("--auth-secret")
@@ -53,9 +176,41 @@ func main() {
 		llog.Fatal("--auth-secret is required")
 	}
 
-	redisAddr, _ := l.ParamStr("--redis-addr")
-	redisPoolSize, _ := l.ParamInt("--redis-pool-size")
-	redisNumSubConns, _ := l.ParamInt("--redis-num-sub-conns")
+	redisOpts := distr.Opts{}
+	redisOpts.Addr, _ = l.ParamStr("--redis-addr")
+	redisOpts.SentinelMaster, _ = l.ParamStr("--redis-sentinel-master")
+	redisOpts.User, _ = l.ParamStr("--redis-user")
+	redisOpts.Password, _ = l.ParamStr("--redis-password")
+	redisOpts.DB, _ = l.ParamInt("--redis-db")
+	redisOpts.PoolSize, _ = l.ParamInt("--redis-pool-size")
+	redisOpts.NumSubConns, _ = l.ParamInt("--redis-num-sub-conns")
+	redisOpts.ShardedPubSub = l.ParamFlag("--redis-sharded-pubsub")
+	redisOpts.InterestBuckets, _ = l.ParamInt("--redis-interest-buckets")
+	redisOpts.Streams = l.ParamFlag("--redis-streams")
+	redisOpts.StreamMaxLen, _ = l.ParamInt("--redis-stream-max-len")
+	redisOpts.PubQueueSize, _ = l.ParamInt("--pub-queue-size")
+	redisOpts.DropOnFull = l.ParamFlag("--drop-on-full")
+
+	if l.ParamFlag("--redis-tls") {
+		redisOpts.TLSConfig = &tls.Config{
+			InsecureSkipVerify: l.ParamFlag("--redis-tls-skip-verify"),
+		}
+		if caFile, _ := l.ParamStr("--redis-tls-ca-file"); caFile != "" {
+			b, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				llog.Fatal("could not read --redis-tls-ca-file", llog.KV{
+					"file": caFile,
+					"err":  err,
+				})
+			}
+			redisOpts.TLSConfig.RootCAs = x509.NewCertPool()
+			if !redisOpts.TLSConfig.RootCAs.AppendCertsFromPEM(b) {
+				llog.Fatal("no certificates found in --redis-tls-ca-file", llog.KV{
+					"file": caFile,
+				})
+			}
+		}
+	}
 
 	wsURLRaw, _ := l.ParamStr("--ws-url")
 	wsURL, err := url.Parse(wsURLRaw)
@@ -69,10 +224,75 @@ func main() {
 		wsURL.Path += "/"
 	}
 
-	distr.Init(redisAddr, redisPoolSize, redisNumSubConns)
-	ws.Init(secret, redisNumSubConns)
+	if urls, _ := l.ParamStrs("--webhook-url"); len(urls) > 0 {
+		whOpts := webhook.Opts{
+			URLs:      urls,
+			Publishes: l.ParamFlag("--webhook-publishes"),
+		}
+		// signed bodies would be valid presence signatures if --auth-secret
+		// were used, allowing anyone who receives one to connect with it
+		if whOpts.Secret, _ = l.ParamStr("--webhook-secret"); whOpts.Secret == "" {
+			llog.Fatal("--webhook-secret is required if --webhook-url is set")
+		} else if whOpts.Secret == secret {
+			llog.Fatal("--webhook-secret must be different from --auth-secret")
+		}
+		whOpts.QueueSize, _ = l.ParamInt("--webhook-queue-size")
+		whOpts.MaxAttempts, _ = l.ParamInt("--webhook-max-attempts")
+		timeoutStr, _ := l.ParamStr("--webhook-timeout")
+		if whOpts.Timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			llog.Fatal("could not parse --webhook-timeout", llog.KV{
+				"timeout": timeoutStr,
+				"err":     err,
+			})
+		}
+		webhook.Init(whOpts)
+		distr.PublishHook = webhook.HandlePub
+	}
+
+	if authzURL, _ := l.ParamStr("--authz-url"); authzURL != "" {
+		authzOpts := authz.Opts{
+			URL:      authzURL,
+			FailOpen: l.ParamFlag("--authz-fail-open"),
+		}
+		// as with --webhook-secret, signed bodies would otherwise be valid
+		// presence signatures
+		if authzOpts.Secret, _ = l.ParamStr("--authz-secret"); authzOpts.Secret == "" {
+			llog.Fatal("--authz-secret is required if --authz-url is set")
+		} else if authzOpts.Secret == secret {
+			llog.Fatal("--authz-secret must be different from --auth-secret")
+		}
+		timeoutStr, _ := l.ParamStr("--authz-timeout")
+		if authzOpts.Timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			llog.Fatal("could not parse --authz-timeout", llog.KV{
+				"timeout": timeoutStr,
+				"err":     err,
+			})
+		}
+		ttlStr, _ := l.ParamStr("--authz-cache-ttl")
+		if authzOpts.CacheTTL, err = time.ParseDuration(ttlStr); err != nil {
+			llog.Fatal("could not parse --authz-cache-ttl", llog.KV{
+				"ttl": ttlStr,
+				"err": err,
+			})
+		}
+		authz.Init(authzOpts)
+	}
+
+	if nsFile, _ := l.ParamStr("--namespaces"); nsFile != "" {
+		if err := namespace.Load(nsFile); err != nil {
+			llog.Fatal("could not load --namespaces", llog.KV{
+				"file": nsFile,
+				"err":  err,
+			})
+		}
+	}
+
+	distr.Init(redisOpts)
+	ws.Init(secret, redisOpts.NumSubConns)
 
-	h := http.StripPrefix(wsURL.Path, ws.NewHandler())
+	// The path's leading slash is left on, so the websocket handshake can
+	// still make sense of it
+	h := http.StripPrefix(strings.TrimSuffix(wsURL.Path, "/"), ws.NewHandler())
 	http.Handle(wsURL.Path, h)
 	llog.Info("websocket interface listening", llog.KV{"addr": wsURL})
 	err = http.ListenAndServe(wsURL.Host, nil)
@@ -0,0 +1,134 @@
+// Package namespace allows for channels to behave differently depending on
+// their names. Namespaces are defined in a json config file, keyed by pattern:
+//
+//	{
+//		"chat:*": {"historySize": 50, "anonymousSubscribe": false},
+//		"notify:*": {"clientPublish": false, "presenceEvents": false},
+//		"*": {"maxMessageSize": 65536}
+//	}
+//
+// A pattern ending in "*" matches all channels starting with the rest of it,
+// any other pattern matches only the channel with that exact name. If more than
+// one pattern matches a channel an exact match is used first, then the longest
+// prefix. Any options not given for a namespace take their values from
+// Default, as do channels which don't match any namespace.
+package namespace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Opts are the options which can be set for each namespace
+type Opts struct {
+	// Whether non-backend connections may publish to the channel
+	ClientPublish bool `json:"clientPublish"`
+
+	// Whether "sub", "unsub" and "presence" publishes are made for the channel
+	PresenceEvents bool `json:"presenceEvents"`
+
+	// Number of publishes, from both clients and backend applications, to keep
+	// for the channel, so they can be retrieved by connections which weren't
+	// subscribed when they were made. 0 means none are kept.
+	HistorySize int `json:"historySize"`
+
+	// Maximum size, in bytes, of the message of a publish to the channel. 0
+	// means there is no maximum.
+	MaxMessageSize int `json:"maxMessageSize"`
+
+	// Whether connections with no presence may subscribe to the channel
+	AnonymousSubscribe bool `json:"anonymousSubscribe"`
+}
+
+// Default is the Opts used for channels not in any namespace, and the starting
+// point for those which are. It reflects how otter behaves without any
+// namespaces.
+var Default = Opts{
+	ClientPublish:      true,
+	PresenceEvents:     true,
+	AnonymousSubscribe: true,
+}
+
+// Namespaces maps patterns to the Opts for channels matching them
+type Namespaces map[string]Opts
+
+// Parse parses the json encoded Namespaces in the given config
+func Parse(b []byte) (Namespaces, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	nn := Namespaces{}
+	for pattern, rawOpts := range raw {
+		o := Default
+		if err := json.Unmarshal(rawOpts, &o); err != nil {
+			return nil, fmt.Errorf("namespace %q: %s", pattern, err)
+		}
+		if o.HistorySize < 0 || o.MaxMessageSize < 0 {
+			return nil, fmt.Errorf("namespace %q: sizes can't be negative", pattern)
+		}
+		nn[pattern] = o
+	}
+	return nn, nil
+}
+
+// Get returns the Opts for the given channel
+func (nn Namespaces) Get(channel string) Opts {
+	if o, ok := nn[channel]; ok && !strings.HasSuffix(channel, "*") {
+		return o
+	}
+
+	o, longest := Default, -1
+	for pattern, po := range nn {
+		if !strings.HasSuffix(pattern, "*") {
+			continue
+		}
+		prefix := strings.TrimSuffix(pattern, "*")
+		if len(prefix) > longest && strings.HasPrefix(channel, prefix) {
+			o, longest = po, len(prefix)
+		}
+	}
+	return o
+}
+
+var (
+	currentL sync.RWMutex
+	current  Namespaces
+)
+
+// Load reads and parses the config file at the given path, and uses it for
+// all subsequent calls to Get
+func Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	nn, err := Parse(b)
+	if err != nil {
+		return err
+	}
+	Set(nn)
+	return nil
+}
+
+// Set causes the given Namespaces to be used for all subsequent calls to Get.
+// It's safe to call while otter is running, e.g. in tests using ottertest, but
+// connections which are already open won't be re-checked against the new
+// Namespaces.
+func Set(nn Namespaces) {
+	currentL.Lock()
+	defer currentL.Unlock()
+	current = nn
+}
+
+// Get returns the Opts for the given channel, using the Namespaces passed to
+// Load or Set. If neither has been called Default is returned.
+func Get(channel string) Opts {
+	currentL.RLock()
+	defer currentL.RUnlock()
+	return current.Get(channel)
+}
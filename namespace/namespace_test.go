@@ -0,0 +1,58 @@
+package namespace
+
+import (
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *T) {
+	nn, err := Parse([]byte(`{
+		"chat:*": {"historySize": 50, "anonymousSubscribe": false},
+		"notify:*": {"clientPublish": false, "presenceEvents": false}
+	}`))
+	require.Nil(t, err)
+
+	chat := Default
+	chat.HistorySize = 50
+	chat.AnonymousSubscribe = false
+	notify := Default
+	notify.ClientPublish = false
+	notify.PresenceEvents = false
+	assert.Equal(t, Namespaces{"chat:*": chat, "notify:*": notify}, nn)
+
+	_, err = Parse([]byte(`{"chat:*": {"historySize": -1}}`))
+	assert.NotNil(t, err)
+	_, err = Parse([]byte(`{"chat:*": {"historySize": "foo"}}`))
+	assert.NotNil(t, err)
+	_, err = Parse([]byte(`[]`))
+	assert.NotNil(t, err)
+}
+
+func TestGet(t *T) {
+	a := Opts{HistorySize: 1}
+	ab := Opts{HistorySize: 2}
+	exact := Opts{HistorySize: 3}
+	all := Opts{HistorySize: 4}
+	nn := Namespaces{
+		"a:*":    a,
+		"a:b:*":  ab,
+		"a:b:c":  exact,
+		"nope:*": {},
+	}
+
+	assert.Equal(t, a, nn.Get("a:"))
+	assert.Equal(t, a, nn.Get("a:foo"))
+	assert.Equal(t, ab, nn.Get("a:b:"))
+	assert.Equal(t, ab, nn.Get("a:b:cd"))
+	assert.Equal(t, exact, nn.Get("a:b:c"))
+	assert.Equal(t, Default, nn.Get("b:foo"))
+	assert.Equal(t, Default, nn.Get("a"))
+
+	nn["*"] = all
+	assert.Equal(t, all, nn.Get("b:foo"))
+	assert.Equal(t, a, nn.Get("a:foo"))
+
+	assert.Equal(t, Default, Namespaces(nil).Get("a:foo"))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/levenlabs/otter/go-otter"
+)
+
+type benchOpts struct {
+	conns      int
+	channels   int
+	rate       int
+	publishers int
+	duration   time.Duration
+}
+
+// benchMsg is what's published during a benchmark
+type benchMsg struct {
+	SentAt int64 `json:"sentAt"`
+}
+
+type benchResults struct {
+	sent, pubErrs, subErrs, received uint64
+
+	l         sync.Mutex
+	latencies []time.Duration
+	// number of times each channel was published to
+	sentPerCh map[string]uint64
+}
+
+func (r *benchResults) addLatency(d time.Duration) {
+	r.l.Lock()
+	r.latencies = append(r.latencies, d)
+	r.l.Unlock()
+}
+
+func (r *benchResults) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p)
+	return r.latencies[i]
+}
+
+// bench opens conns client connections, spread across channels, and has
+// publishers backend connections publish to those channels at a total of rate
+// publishes per second, for the given duration. Delivery latency, drops and
+// errors are reported at the end.
+func bench(client, backend otter.Client, o benchOpts) {
+	if o.conns < 1 || o.channels < 1 || o.rate < 1 || o.publishers < 1 {
+		fatalf("--bench-conns, --bench-channels, --bench-rate and --bench-publishers must all be at least 1")
+	}
+	// each publisher ticks every publishers/rate seconds, which can't be less
+	// than a nanosecond
+	if int64(o.rate) > int64(time.Second)*int64(o.publishers) {
+		fatalf("--bench-rate can be at most %d times --bench-publishers", int64(time.Second))
+	}
+
+	prefixB := make([]byte, 4)
+	if _, err := rand.Read(prefixB); err != nil {
+		fatalf("error generating channel prefix: %s", err)
+	}
+	chs := make([]string, o.channels)
+	for i := range chs {
+		chs[i] = fmt.Sprintf("bench-%s-%d", hex.EncodeToString(prefixB), i)
+	}
+
+	res := &benchResults{sentPerCh: map[string]uint64{}}
+	connsPerCh := map[string]uint64{}
+	stopCh := make(chan struct{})
+
+	fmt.Printf("opening %d connections across %d channels\n", o.conns, o.channels)
+	for i := 0; i < o.conns; i++ {
+		ch := chs[i%len(chs)]
+		pubCh := make(chan otter.Pub, 10)
+		errCh := client.Subscribe(pubCh, stopCh, ch)
+		select {
+		case err := <-errCh:
+			atomic.AddUint64(&res.subErrs, 1)
+			fmt.Printf("error subscribing: %s\n", err)
+			continue
+		default:
+		}
+		connsPerCh[ch]++
+		go benchRead(res, pubCh, errCh, stopCh)
+	}
+	// give otter a moment to register all the subscriptions
+	time.Sleep(1 * time.Second)
+
+	fmt.Printf("publishing at %d/s with %d publishers for %s\n", o.rate, o.publishers, o.duration)
+	interval := time.Duration(int64(time.Second) * int64(o.publishers) / int64(o.rate))
+	var wg sync.WaitGroup
+	for i := 0; i < o.publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			benchPublish(backend, res, chs, i, interval, o.duration)
+		}(i)
+	}
+	wg.Wait()
+
+	// give the last publishes time to be delivered
+	time.Sleep(2 * time.Second)
+	close(stopCh)
+
+	var expected uint64
+	for ch, n := range res.sentPerCh {
+		expected += n * connsPerCh[ch]
+	}
+	received := atomic.LoadUint64(&res.received)
+	var dropped uint64
+	if expected > received {
+		dropped = expected - received
+	}
+
+	res.l.Lock()
+	defer res.l.Unlock()
+	sort.Slice(res.latencies, func(i, j int) bool {
+		return res.latencies[i] < res.latencies[j]
+	})
+	fmt.Printf("\n")
+	fmt.Printf("published:         %d (%d errors)\n", res.sent, res.pubErrs)
+	fmt.Printf("subscribe errors:  %d\n", res.subErrs)
+	fmt.Printf("expected delivers: %d\n", expected)
+	fmt.Printf("delivered:         %d (%.1f/s)\n", received, float64(received)/o.duration.Seconds())
+	fmt.Printf("dropped:           %d\n", dropped)
+	fmt.Printf("latency p50:       %s\n", res.percentile(0.5))
+	fmt.Printf("latency p90:       %s\n", res.percentile(0.9))
+	fmt.Printf("latency p99:       %s\n", res.percentile(0.99))
+	fmt.Printf("latency max:       %s\n", res.percentile(1))
+}
+
+func benchRead(res *benchResults, pubCh <-chan otter.Pub, errCh <-chan error, stopCh chan struct{}) {
+	for {
+		select {
+		case p := <-pubCh:
+			if p.Type != "pub" || p.Message == nil {
+				continue
+			}
+			var msg benchMsg
+			if err := json.Unmarshal(*p.Message, &msg); err != nil {
+				continue
+			}
+			atomic.AddUint64(&res.received, 1)
+			res.addLatency(time.Since(time.Unix(0, msg.SentAt)))
+		case err := <-errCh:
+			select {
+			case <-stopCh:
+			default:
+				atomic.AddUint64(&res.subErrs, 1)
+				fmt.Printf("subscription closed: %s\n", err)
+			}
+			return
+		}
+	}
+}
+
+func benchPublish(backend otter.Client, res *benchResults, chs []string, i int, interval, duration time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	end := time.After(duration)
+	for j := i; ; j++ {
+		select {
+		case <-tick.C:
+		case <-end:
+			return
+		}
+
+		ch := chs[j%len(chs)]
+		if err := backend.Publish(benchMsg{SentAt: time.Now().UnixNano()}, ch); err != nil {
+			atomic.AddUint64(&res.pubErrs, 1)
+			continue
+		}
+		atomic.AddUint64(&res.sent, 1)
+		res.l.Lock()
+		res.sentPerCh[ch]++
+		res.l.Unlock()
+	}
+}
@@ -5,9 +5,15 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/conn"
 	"github.com/levenlabs/otter/go-otter"
+	"github.com/levenlabs/otter/ws"
 	"github.com/mediocregopher/lever"
 )
 
@@ -18,6 +24,20 @@ func fatalf(str string, args ...interface{}) {
 	os.Exit(1)
 }
 
+func presenceFunc(presence, secret string) otter.PresenceFunc {
+	return func() (string, string, error) {
+		return presence, (auth.Auth{Key: secret}).Sign(presence), nil
+	}
+}
+
+func printJSON(i interface{}) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		fatalf("error marshalling json: %s", err)
+	}
+	fmt.Println(string(b))
+}
+
 func main() {
 	l := lever.New("otter-cli", &lever.Opts{
 		DisallowConfigFile: true,
@@ -59,6 +79,108 @@ func main() {
 		Description: "Lists all the connection objects subscribed to the given set of channels",
 		Flag:        true,
 	})
+	l.Add(lever.Param{
+		Name:        "--stream",
+		Description: "Used with --list-subbed to stream the list rather than retrieving it all at once. Each connection is printed along with the channels it is subscribed to",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--list-channels",
+		Description: "Lists all channels which have clients subscribed to them, along with how many. See also --channel-prefix",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--channel-prefix",
+		Description: "Used with --list-channels to only list channels starting with this prefix",
+	})
+	l.Add(lever.Param{
+		Name:        "--get-conn",
+		Description: "Prints information about the connection with the given ID, including its channels, node, and when it was made",
+	})
+	l.Add(lever.Param{
+		Name:        "--find-presence",
+		Description: "Prints information about all connections with the given presence string",
+	})
+	l.Add(lever.Param{
+		Name:        "--count",
+		Description: "Prints the number of clients subscribed to each of the given channels",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--count-presences",
+		Description: "Used with --count to also print the number of distinct presences amongst the clients subscribed to each channel",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--presence-filter",
+		Description: "Used with --list-subbed to only list connections whose presence object has the given field, in the form path=value (e.g. user.id=123). May be specified more than once",
+	})
+	l.Add(lever.Param{
+		Name:        "--interactive",
+		Aliases:     []string{"-i"},
+		Description: "Starts an interactive prompt for subscribing, publishing, etc... Any channels given are subscribed to initially. Type help at the prompt for the list of commands",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--bench",
+		Description: "Runs a benchmark against otter, with client connections subscribing to channels and backend connections publishing to them. Latency, drops, and errors are reported. --auth-secret is required",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--bench-conns",
+		Description: "Number of client connections to make during --bench",
+		Default:     "100",
+	})
+	l.Add(lever.Param{
+		Name:        "--bench-channels",
+		Description: "Number of channels to spread client connections across during --bench",
+		Default:     "10",
+	})
+	l.Add(lever.Param{
+		Name:        "--bench-rate",
+		Description: "Total number of publishes per second to make during --bench",
+		Default:     "100",
+	})
+	l.Add(lever.Param{
+		Name:        "--bench-publishers",
+		Description: "Number of backend publishers to spread publishes across during --bench",
+		Default:     "1",
+	})
+	l.Add(lever.Param{
+		Name:        "--bench-duration",
+		Description: "How long to publish for during --bench",
+		Default:     "10s",
+	})
+	l.Add(lever.Param{
+		Name:        "--sign",
+		Description: "Prints a signature for the --presence (or --backend) using --auth-secret",
+		Flag:        true,
+	})
+	l.Add(lever.Param{
+		Name:        "--verify",
+		Description: "Verifies that the given signature is valid for --presence (or --backend) and --auth-secret, and says why if not. See also --sig-timeout",
+	})
+	l.Add(lever.Param{
+		Name:        "--decode-sig",
+		Description: "Prints the timestamp and age of the given signature, without verifying it",
+	})
+	l.Add(lever.Param{
+		Name:        "--sig-timeout",
+		Description: "If set, --verify will also check that the signature is no older than this duration (e.g. 30s). Should match the auth timeout of the otter instance",
+	})
+	l.Add(lever.Param{
+		Name:        "--record",
+		Description: "Subscribes to the channels given and writes every frame received, with the time it was received, to the given file as newline delimited json. Use - for stdout",
+	})
+	l.Add(lever.Param{
+		Name:        "--replay",
+		Description: "Publishes every publish in the given file, as written by --record, to its original channel, or to the channels given if any. See also --replay-speed",
+	})
+	l.Add(lever.Param{
+		Name:        "--replay-speed",
+		Description: "Speed multiplier for --replay, relative to the speed the publishes were recorded at. 0 means as fast as possible",
+		Default:     "1",
+	})
 	l.Parse()
 
 	ustr, _ := l.ParamStr("--otter-url")
@@ -75,21 +197,125 @@ func main() {
 	if backend := l.ParamFlag("--backend"); backend {
 		presence = "backend"
 	}
+	sec, _ := l.ParamStr("--auth-secret")
+
+	if sig, _ := l.ParamStr("--decode-sig"); sig != "" {
+		decodeSig(sig)
+		return
+	}
+
+	if l.ParamFlag("--sign") {
+		if sec == "" {
+			fatalf("--auth-secret required with --sign")
+		}
+		signPresence(presence, sec)
+		return
+	}
+
+	if sig, _ := l.ParamStr("--verify"); sig != "" {
+		if sec == "" {
+			fatalf("--auth-secret required with --verify")
+		}
+		var timeout time.Duration
+		if toStr, _ := l.ParamStr("--sig-timeout"); toStr != "" {
+			if timeout, err = time.ParseDuration(toStr); err != nil {
+				fatalf("invalid --sig-timeout: %s", err)
+			}
+		}
+		verifySig(sig, presence, sec, timeout)
+		return
+	}
+
 	if presence != "" {
-		sec, _ := l.ParamStr("--auth-secret")
 		if sec == "" {
 			fatalf("--auth-secret required with --presence and --backend")
 		}
-		c.PresenceFunc = func() (string, string, error) {
-			return presence, (auth.Auth{Key: sec}).Sign(presence), nil
+		c.PresenceFunc = presenceFunc(presence, sec)
+	}
+
+	if l.ParamFlag("--bench") {
+		if sec == "" {
+			fatalf("--auth-secret required with --bench")
+		}
+		var o benchOpts
+		o.conns, _ = l.ParamInt("--bench-conns")
+		o.channels, _ = l.ParamInt("--bench-channels")
+		o.rate, _ = l.ParamInt("--bench-rate")
+		o.publishers, _ = l.ParamInt("--bench-publishers")
+		durStr, _ := l.ParamStr("--bench-duration")
+		if o.duration, err = time.ParseDuration(durStr); err != nil {
+			fatalf("invalid --bench-duration: %s", err)
 		}
+		backend := c
+		backend.PresenceFunc = otter.BackendPresence(sec)
+		bench(c, backend, o)
+		return
 	}
 
 	chs, _ := l.ParamStrs("--channel")
+	if path, _ := l.ParamStr("--replay"); path != "" {
+		speedStr, _ := l.ParamStr("--replay-speed")
+		speed, err := strconv.ParseFloat(speedStr, 64)
+		if err != nil || speed < 0 {
+			fatalf("invalid --replay-speed: %q", speedStr)
+		}
+		replay(c, path, speed, chs)
+		return
+	}
+
+	if l.ParamFlag("--interactive") {
+		newREPL(c, sec, presence).run(chs)
+		return
+	}
+
+	if id, _ := l.ParamStr("--get-conn"); id != "" {
+		ci, ok, err := c.GetConn(conn.ID(id))
+		if err != nil {
+			fatalf("error getting connection: %s", err)
+		} else if !ok {
+			fatalf("connection not found")
+		}
+		printJSON(ci)
+		return
+	}
+
+	if p, _ := l.ParamStr("--find-presence"); p != "" {
+		cis, err := c.FindConns(p)
+		if err != nil {
+			fatalf("error finding connections: %s", err)
+		}
+		for _, ci := range cis {
+			printJSON(ci)
+		}
+		return
+	}
+
+	if l.ParamFlag("--list-channels") {
+		prefix, _ := l.ParamStr("--channel-prefix")
+		counts, err := c.GetChannels(prefix)
+		if err != nil {
+			fatalf("error listing channels: %s", err)
+		}
+		names := make([]string, 0, len(counts))
+		for ch := range counts {
+			names = append(names, ch)
+		}
+		sort.Strings(names)
+		for _, ch := range names {
+			fmt.Printf("%s\tconns:%d\n", ch, counts[ch].Conns)
+		}
+		return
+	}
+
 	if len(chs) == 0 {
 		fatalf("at least one --channel (-c) required")
 	}
 
+	if path, _ := l.ParamStr("--record"); path != "" {
+		record(c, path, chs)
+		return
+	}
+
 	if l.ParamFlag("--sub") {
 		pubCh := make(chan otter.Pub)
 		errCh := c.Subscribe(pubCh, nil, chs...)
@@ -117,7 +343,31 @@ func main() {
 	}
 
 	if l.ParamFlag("--list-subbed") {
-		conns, err := c.GetSubscribed(chs...)
+		filter := map[string]string{}
+		filterStrs, _ := l.ParamStrs("--presence-filter")
+		for _, f := range filterStrs {
+			p := strings.SplitN(f, "=", 2)
+			if len(p) != 2 {
+				fatalf("invalid --presence-filter: %q", f)
+			}
+			filter[p[0]] = p[1]
+		}
+		if l.ParamFlag("--stream") {
+			err := c.StreamSubscribed(filter, func(e ws.SubListEntry) error {
+				b, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(b))
+				return nil
+			}, chs...)
+			if err != nil {
+				fatalf("error streaming sub list: %s", err)
+			}
+			return
+		}
+
+		conns, err := c.GetSubscribedFiltered(filter, chs...)
 		if err != nil {
 			fatalf("error retrieving sub list: %s", err)
 		}
@@ -131,5 +381,26 @@ func main() {
 		return
 	}
 
-	fatalf("--sub or --pub must be given")
+	if l.ParamFlag("--count") {
+		var counts map[string]ws.SubCount
+		if l.ParamFlag("--count-presences") {
+			counts, err = c.CountSubscribedPresences(chs...)
+		} else {
+			counts, err = c.CountSubscribed(chs...)
+		}
+		if err != nil {
+			fatalf("error retrieving counts: %s", err)
+		}
+		for _, ch := range chs {
+			sc := counts[ch]
+			if sc.Presences != nil {
+				fmt.Printf("%s\tconns:%d\tpresences:%d\n", ch, sc.Conns, *sc.Presences)
+			} else {
+				fmt.Printf("%s\tconns:%d\n", ch, sc.Conns)
+			}
+		}
+		return
+	}
+
+	fatalf("--sub, --pub, --list-subbed, --count, --list-channels, --get-conn, --find-presence, --record, --replay, --interactive, --bench, --sign, --verify or --decode-sig must be given")
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/levenlabs/otter/go-otter"
+)
+
+// recordedPub is a single line of a recording
+type recordedPub struct {
+	ReceivedAt time.Time `json:"receivedAt"`
+	Pub        otter.Pub `json:"pub"`
+}
+
+// record subscribes to the given channels and writes every frame received to
+// the file at the given path (or stdout if it's "-"), as newline delimited
+// json, until the connection is closed
+func record(c otter.Client, path string, chs []string) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fatalf("error creating --record file: %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+
+	pubCh := make(chan otter.Pub)
+	errCh := c.Subscribe(pubCh, nil, chs...)
+	for {
+		select {
+		case p := <-pubCh:
+			rp := recordedPub{ReceivedAt: time.Now(), Pub: p}
+			if err := enc.Encode(rp); err != nil {
+				fatalf("error writing to --record file: %s", err)
+			}
+		case err := <-errCh:
+			fatalf("error reading from otter: %s", err)
+		}
+	}
+}
+
+// replay reads a file written by record and publishes each "pub" frame in it,
+// either to its original channel or to chs if any are given. Publishes are
+// spaced out according to when they were originally received, with the spacing
+// divided by speed. If speed is zero publishes are made as fast as possible.
+func replay(c otter.Client, path string, speed float64, chs []string) {
+	f, err := os.Open(path)
+	if err != nil {
+		fatalf("error opening --replay file: %s", err)
+	}
+	defer f.Close()
+
+	var start, firstAt time.Time
+	var n int
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		var rp recordedPub
+		if err := json.Unmarshal(s.Bytes(), &rp); err != nil {
+			fatalf("error decoding line %d of --replay file: %s", line, err)
+		}
+		if rp.Pub.Type != "pub" || rp.Pub.Message == nil {
+			continue
+		}
+
+		if start.IsZero() {
+			start, firstAt = time.Now(), rp.ReceivedAt
+		} else if speed > 0 {
+			offset := time.Duration(float64(rp.ReceivedAt.Sub(firstAt)) / speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		pubChs := chs
+		if len(pubChs) == 0 {
+			pubChs = []string{rp.Pub.Channel}
+		}
+		if err := c.Publish(rp.Pub.Message, pubChs...); err != nil {
+			fatalf("error publishing line %d of --replay file: %s", line, err)
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		fatalf("error reading --replay file: %s", err)
+	}
+	fmt.Printf("replayed %d publishes\n", n)
+}
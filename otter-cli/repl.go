@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/levenlabs/otter/go-otter"
+)
+
+const replHelp = `Commands:
+  sub <channel> [channel...]     subscribe to channels
+  unsub <channel> [channel...]   unsubscribe from channels
+  pub <channel[,channel...]> <json>
+                                 publish json to channels
+  list <channel> [channel...]    list connections subscribed to channels
+  presence [presence]            show or change presence (needs --auth-secret)
+  backend                        change presence to backend (needs --auth-secret)
+  anon                           change to having no presence
+  help                           show this message
+  quit                           exit
+
+Changing subscriptions or presence causes the subscription connection to be
+remade.`
+
+type repl struct {
+	c        otter.Client
+	secret   string
+	presence string
+
+	subs   map[string]bool
+	stopCh chan struct{}
+}
+
+func newREPL(c otter.Client, secret, presence string) *repl {
+	return &repl{
+		c:        c,
+		secret:   secret,
+		presence: presence,
+		subs:     map[string]bool{},
+	}
+}
+
+func (r *repl) printf(str string, args ...interface{}) {
+	ts := time.Now().Format("15:04:05.000")
+	fmt.Printf(ts+" "+str+"\n", args...)
+}
+
+func (r *repl) run(initSubs []string) {
+	if len(initSubs) > 0 {
+		if err := r.sub(initSubs); err != nil {
+			fmt.Printf("error: %s\n", err)
+		}
+	}
+
+	fmt.Println(`type "help" for the list of commands`)
+	s := bufio.NewScanner(os.Stdin)
+	for fmt.Print("> "); s.Scan(); fmt.Print("> ") {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		} else if line == "quit" || line == "exit" {
+			return
+		}
+		if err := r.do(line); err != nil {
+			fmt.Printf("error: %s\n", err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		fatalf("error reading input: %s", err)
+	}
+}
+
+func (r *repl) do(line string) error {
+	fields := strings.Fields(line)
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "help":
+		fmt.Println(replHelp)
+	case "sub":
+		if len(args) == 0 {
+			return errors.New("at least one channel required")
+		}
+		return r.sub(args)
+	case "unsub":
+		if len(args) == 0 {
+			return errors.New("at least one channel required")
+		}
+		return r.unsub(args)
+	case "pub":
+		return r.pub(line)
+	case "list":
+		return r.list(args)
+	case "presence":
+		if len(args) == 0 {
+			fmt.Printf("presence: %q\n", r.presence)
+			return nil
+		}
+		return r.setPresence(strings.Join(args, " "))
+	case "backend":
+		return r.setPresence("backend")
+	case "anon":
+		return r.setPresence("")
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+func (r *repl) sub(chs []string) error {
+	for _, ch := range chs {
+		r.subs[ch] = true
+	}
+	return r.resubscribe()
+}
+
+func (r *repl) unsub(chs []string) error {
+	for _, ch := range chs {
+		delete(r.subs, ch)
+	}
+	return r.resubscribe()
+}
+
+// resubscribe closes the current subscription connection, if any, and makes a
+// new one for the current set of subs. The subs are kept even if the new
+// connection couldn't be made, so the next change will try again.
+func (r *repl) resubscribe() error {
+	if r.stopCh != nil {
+		close(r.stopCh)
+		r.stopCh = nil
+	}
+	if len(r.subs) == 0 {
+		fmt.Println("not subscribed to anything")
+		return nil
+	}
+
+	subs := make([]string, 0, len(r.subs))
+	for ch := range r.subs {
+		subs = append(subs, ch)
+	}
+	sort.Strings(subs)
+
+	stopCh := make(chan struct{})
+	pubCh := make(chan otter.Pub)
+	errCh := r.c.Subscribe(pubCh, stopCh, subs...)
+	// Subscribe makes the connection before returning, so if it failed the
+	// error is already waiting
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("subscribing to %s: %s", strings.Join(subs, ","), err)
+	default:
+	}
+	r.stopCh = stopCh
+	fmt.Printf("subscribed to %s\n", strings.Join(subs, ","))
+
+	go func() {
+		for {
+			select {
+			case p := <-pubCh:
+				b, err := json.Marshal(p)
+				if err != nil {
+					r.printf("error marshalling publish: %s", err)
+					continue
+				}
+				r.printf("%s", b)
+			case err := <-errCh:
+				select {
+				case <-stopCh:
+				default:
+					r.printf("subscription closed: %s", err)
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *repl) pub(line string) error {
+	p := splitFields(line, 3)
+	if len(p) < 3 {
+		return errors.New("usage: pub <channel[,channel...]> <json>")
+	}
+
+	var msg interface{}
+	if err := json.Unmarshal([]byte(p[2]), &msg); err != nil {
+		return fmt.Errorf("invalid json: %s", err)
+	}
+	return r.c.Publish(msg, strings.Split(p[1], ",")...)
+}
+
+// splitFields is like strings.Fields, but returns at most n fields, the last of
+// which is the remainder of str as-is, so any whitespace within it is kept
+func splitFields(str string, n int) []string {
+	var ff []string
+	for len(ff) < n-1 {
+		str = strings.TrimLeftFunc(str, unicode.IsSpace)
+		i := strings.IndexFunc(str, unicode.IsSpace)
+		if i < 0 {
+			break
+		}
+		ff = append(ff, str[:i])
+		str = str[i:]
+	}
+	if str = strings.TrimLeftFunc(str, unicode.IsSpace); str != "" {
+		ff = append(ff, str)
+	}
+	return ff
+}
+
+func (r *repl) list(chs []string) error {
+	if len(chs) == 0 {
+		return errors.New("at least one channel required")
+	}
+	conns, err := r.c.GetSubscribed(chs...)
+	if err != nil {
+		return err
+	}
+	for _, c := range conns {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	fmt.Printf("%d connection(s)\n", len(conns))
+	return nil
+}
+
+func (r *repl) setPresence(presence string) error {
+	if presence == "" {
+		r.c.PresenceFunc = nil
+	} else if r.secret == "" {
+		return errors.New("--auth-secret is required to change presence")
+	} else {
+		r.c.PresenceFunc = presenceFunc(presence, r.secret)
+	}
+	r.presence = presence
+	fmt.Printf("presence: %q\n", r.presence)
+
+	if len(r.subs) > 0 {
+		return r.resubscribe()
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/levenlabs/otter/auth"
+)
+
+// signPresence prints a signature for the given presence
+func signPresence(presence, secret string) {
+	fmt.Println((auth.Auth{Key: secret}).Sign(presence))
+}
+
+// verifySig prints whether the given signature is valid for the given
+// presence, and if not why not, exiting non-zero if it isn't. If timeout is
+// not zero the signature must also be younger than it.
+func verifySig(sig, presence, secret string, timeout time.Duration) {
+	t, err := auth.SigTime(sig)
+	if err != nil {
+		fatalf("invalid: %s", err)
+	}
+
+	if !(auth.Auth{Key: secret}).Verify(sig, presence) {
+		fatalf("invalid: signature does not match presence and secret")
+	}
+
+	age := time.Since(t)
+	if timeout > 0 && age > timeout {
+		fatalf("invalid: signature is %s old, which is older than the timeout of %s", age, timeout)
+	}
+	fmt.Println("valid")
+}
+
+// decodeSig prints the time the given signature was made at and its age
+func decodeSig(sig string) {
+	t, err := auth.SigTime(sig)
+	if err != nil {
+		fatalf("invalid signature: %s", err)
+	}
+	fmt.Printf("timestamp: %s\n", t.Format(time.RFC3339Nano))
+	fmt.Printf("age:       %s\n", time.Since(t))
+}
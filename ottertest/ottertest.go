@@ -0,0 +1,95 @@
+// Package ottertest provides an otter server which runs in-process, for use in
+// tests of applications built on top of otter. No redis is needed, all otter
+// data is kept in memory.
+//
+//	srv := ottertest.NewServer()
+//	defer srv.Close()
+//
+//	backend := srv.BackendClient()
+//	client := srv.Client("some presence")
+//
+// Otter's internals are global, so all Servers in a process share the same
+// state, including their secret. Publishes made to one Server will be seen by
+// subscribers to all of them.
+package ottertest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/distr"
+	"github.com/levenlabs/otter/go-otter"
+	"github.com/levenlabs/otter/ws"
+)
+
+var (
+	initOnce sync.Once
+	secret   string
+)
+
+func randHex() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func initOtter() {
+	if conn.NodeID == "" {
+		conn.NodeID = randHex()
+	}
+	secret = randHex()
+	distr.InitMemory()
+	ws.Init(secret, 1)
+}
+
+// Server is an otter instance running on an httptest.Server
+type Server struct {
+	*httptest.Server
+
+	// The secret used to sign and verify presence strings
+	Secret string
+}
+
+// NewServer starts and returns a new Server. Close should be called on it once
+// it's no longer needed.
+func NewServer() *Server {
+	initOnce.Do(initOtter)
+	return &Server{
+		Server: httptest.NewServer(ws.NewHandler()),
+		Secret: secret,
+	}
+}
+
+// Client returns an otter.Client connected to the Server, which will use the
+// given presence string. If presence is empty no presence is used.
+func (s *Server) Client(presence string) otter.Client {
+	c := otter.Client{URLs: []string{s.URL}}
+	if presence != "" {
+		a := auth.Auth{Key: s.Secret}
+		c.PresenceFunc = func() (string, string, error) {
+			return presence, a.Sign(presence), nil
+		}
+	}
+	return c
+}
+
+// BackendClient returns an otter.Client connected to the Server as a backend
+// application
+func (s *Server) BackendClient() otter.Client {
+	return otter.Client{
+		URLs:         []string{s.URL},
+		PresenceFunc: otter.BackendPresence(s.Secret),
+	}
+}
+
+// Sign returns a signature for the given presence string, as a backend
+// application would hand out to its clients
+func (s *Server) Sign(presence string) string {
+	return (auth.Auth{Key: s.Secret}).Sign(presence)
+}
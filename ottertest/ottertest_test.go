@@ -0,0 +1,340 @@
+package ottertest
+
+import (
+	"encoding/json"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/distr"
+	"github.com/levenlabs/otter/go-otter"
+	"github.com/levenlabs/otter/namespace"
+	"github.com/levenlabs/otter/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEnv holds what almost every test needs: a Server, a backend Client for
+// it, and a stopCh which closes every subscription made with it. close should
+// be deferred once it's made.
+type testEnv struct {
+	t       *T
+	srv     *Server
+	backend otter.Client
+	stopCh  chan struct{}
+}
+
+func newTestEnv(t *T) *testEnv {
+	srv := NewServer()
+	e := &testEnv{
+		t:       t,
+		srv:     srv,
+		backend: srv.BackendClient(),
+		stopCh:  make(chan struct{}),
+	}
+	return e
+}
+
+func (e *testEnv) close() {
+	e.stop()
+	e.srv.Close()
+}
+
+// stop closes every subscription made using stopCh. It may be called more than
+// once.
+func (e *testEnv) stop() {
+	select {
+	case <-e.stopCh:
+	default:
+		close(e.stopCh)
+	}
+}
+
+// subscribe subscribes the given Client to the given channels, and waits until
+// otter has registered it, so that anything published afterwards (including
+// the sub messages of other connections) will be received
+func (e *testEnv) subscribe(c otter.Client, pubCh chan otter.Pub, chs ...string) {
+	backend := isBackend(c)
+	before := countSubbed(chs[0], backend)
+	c.Subscribe(pubCh, e.stopCh, chs...)
+	e.waitFor("subscription", func() bool {
+		return countSubbed(chs[0], backend) > before
+	})
+}
+
+// waitFor waits for the given condition to become true, failing the test if it
+// doesn't soon enough
+func (e *testEnv) waitFor(what string, cond func() bool) {
+	for deadline := time.Now().Add(1 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			e.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func isBackend(c otter.Client) bool {
+	if c.PresenceFunc == nil {
+		return false
+	}
+	p, _, _ := c.PresenceFunc()
+	return p == "backend"
+}
+
+func countSubbed(ch string, backend bool) int {
+	n, _ := distr.CountSubscribed(conn.NodeID, ch, backend)
+	return n
+}
+
+func requireRcv(t *T, pubCh <-chan otter.Pub) otter.Pub {
+	select {
+	case p := <-pubCh:
+		return p
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for pub")
+	}
+	return otter.Pub{}
+}
+
+func TestServer(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	ch := testutil.RandStr()
+	presence := testutil.RandStr()
+	backend := e.backend
+	client := e.srv.Client(presence)
+
+	backendCh := make(chan otter.Pub)
+	e.subscribe(backend, backendCh, ch)
+
+	clientCh := make(chan otter.Pub)
+	client.Subscribe(clientCh, e.stopCh, ch)
+
+	p := requireRcv(t, backendCh)
+	assert.Equal(t, "sub", p.Type)
+	assert.Equal(t, presence, p.Conn.Presence)
+
+	conns, err := backend.GetSubscribed(ch)
+	require.Nil(t, err)
+	require.Len(t, conns, 1)
+	assert.Equal(t, presence, conns[0].Presence)
+
+	require.Nil(t, backend.Publish("hi", ch))
+	p = requireRcv(t, clientCh)
+	assert.Equal(t, "pub", p.Type)
+	assert.True(t, p.Conn.IsBackend)
+	var msg string
+	require.Nil(t, json.Unmarshal(*p.Message, &msg))
+	assert.Equal(t, "hi", msg)
+}
+
+func TestServerPresenceFields(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	ch := testutil.RandStr()
+	id := testutil.RandStr()
+	backend := e.backend
+	client := e.srv.Client(`{"user":{"id":"` + id + `"}}`)
+	otherClient := e.srv.Client(`{"user":{"id":"` + testutil.RandStr() + `"}}`)
+
+	backendCh := make(chan otter.Pub)
+	e.subscribe(backend, backendCh, ch)
+
+	clientCh := make(chan otter.Pub, 1)
+	client.Subscribe(clientCh, e.stopCh, ch)
+	p := requireRcv(t, backendCh)
+	assert.Equal(t, "sub", p.Type)
+	assert.Empty(t, p.Conn.Presence)
+	assert.Equal(t, map[string]interface{}{"id": id}, p.Conn.PresenceFields["user"])
+
+	otherClient.Subscribe(clientCh, e.stopCh, ch)
+	requireRcv(t, backendCh)
+
+	conns, err := backend.GetSubscribed(ch)
+	require.Nil(t, err)
+	assert.Len(t, conns, 2)
+
+	conns, err = backend.GetSubscribedFiltered(map[string]string{"user.id": id}, ch)
+	require.Nil(t, err)
+	require.Len(t, conns, 1)
+	assert.Equal(t, p.Conn, conns[0])
+}
+
+func TestServerCount(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	ch, ch2 := testutil.RandStr(), testutil.RandStr()
+	presence := testutil.RandStr()
+	backend := e.backend
+
+	pubCh := make(chan otter.Pub, 10)
+	e.subscribe(e.srv.Client(presence), pubCh, ch)
+	e.subscribe(e.srv.Client(presence), pubCh, ch)
+	e.subscribe(e.srv.Client(""), pubCh, ch)
+	e.subscribe(backend, pubCh, ch)
+
+	counts, err := backend.CountSubscribed(ch, ch2)
+	require.Nil(t, err)
+	assert.Equal(t, 3, counts[ch].Conns)
+	assert.Nil(t, counts[ch].Presences)
+	assert.Equal(t, 0, counts[ch2].Conns)
+
+	counts, err = backend.CountSubscribedPresences(ch, ch2)
+	require.Nil(t, err)
+	assert.Equal(t, 3, counts[ch].Conns)
+	require.NotNil(t, counts[ch].Presences)
+	assert.Equal(t, 1, *counts[ch].Presences)
+	require.NotNil(t, counts[ch2].Presences)
+	assert.Equal(t, 0, *counts[ch2].Presences)
+}
+
+func TestServerStreamSubscribed(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	ch, ch2 := testutil.RandStr(), testutil.RandStr()
+	backend := e.backend
+
+	pubCh := make(chan otter.Pub, 10)
+	e.subscribe(e.srv.Client(testutil.RandStr()), pubCh, ch, ch2)
+	e.subscribe(e.srv.Client(testutil.RandStr()), pubCh, ch2)
+
+	var ee []ws.SubListEntry
+	err := backend.StreamSubscribed(nil, func(e ws.SubListEntry) error {
+		ee = append(ee, e)
+		return nil
+	}, ch, ch2)
+	require.Nil(t, err)
+	require.Len(t, ee, 2)
+	for _, e := range ee {
+		assert.Contains(t, [][]string{{ch, ch2}, {ch2}}, e.Channels)
+	}
+}
+
+func TestServerGetChannels(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	prefix := testutil.RandStr()
+	ch, ch2 := prefix+testutil.RandStr(), prefix+testutil.RandStr()
+	backend := e.backend
+
+	pubCh := make(chan otter.Pub, 10)
+	e.subscribe(e.srv.Client(testutil.RandStr()), pubCh, ch, ch2)
+	e.subscribe(e.srv.Client(testutil.RandStr()), pubCh, ch2)
+	e.subscribe(backend, pubCh, prefix+testutil.RandStr())
+
+	counts, err := backend.GetChannels(prefix)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]ws.SubCount{
+		ch:  {Conns: 1},
+		ch2: {Conns: 2},
+	}, counts)
+
+	counts, err = backend.GetChannels(ch)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]ws.SubCount{ch: {Conns: 1}}, counts)
+
+	e.stop()
+	e.waitFor("unsubscribes", func() bool {
+		counts, err := backend.GetChannels(prefix)
+		return err == nil && len(counts) == 0
+	})
+
+	_, err = e.srv.Client("").GetChannels(prefix)
+	assert.True(t, err.(*otter.HTTPError).Forbidden())
+}
+
+func TestServerConnLookup(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	ch := testutil.RandStr()
+	presence := testutil.RandStr()
+	backend := e.backend
+
+	backendCh := make(chan otter.Pub)
+	e.subscribe(backend, backendCh, ch)
+
+	e.srv.Client(presence).Subscribe(make(chan otter.Pub), e.stopCh, ch)
+	p := requireRcv(t, backendCh)
+	require.Equal(t, "sub", p.Type)
+
+	ci, ok, err := backend.GetConn(p.Conn.ID)
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, p.Conn, ci.Conn)
+	assert.Equal(t, []string{ch}, ci.Channels)
+	assert.Equal(t, p.Conn.ID.NodeID(), ci.NodeID)
+	assert.NotEmpty(t, ci.RemoteAddr)
+	assert.WithinDuration(t, time.Now(), ci.Since, 1*time.Second)
+
+	_, ok, err = backend.GetConn(conn.ID(testutil.RandStr()))
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	cis, err := backend.FindConns(presence)
+	require.Nil(t, err)
+	require.Len(t, cis, 1)
+	assert.Equal(t, p.Conn, cis[0].Conn)
+
+	cis, err = backend.FindConns(testutil.RandStr())
+	require.Nil(t, err)
+	assert.Empty(t, cis)
+}
+
+func TestServerNamespaces(t *T) {
+	e := newTestEnv(t)
+	defer e.close()
+	prefix := testutil.RandStr() + ":"
+	nsOpts := namespace.Default
+	nsOpts.HistorySize = 10
+	nsOpts.MaxMessageSize = 10
+	nsOpts.AnonymousSubscribe = false
+	roOpts := namespace.Default
+	roOpts.ClientPublish = false
+	roOpts.AnonymousSubscribe = false
+	namespace.Set(namespace.Namespaces{
+		prefix + "*":    nsOpts,
+		prefix + "ro:*": roOpts,
+	})
+	defer namespace.Set(nil)
+
+	backend := e.backend
+	client := e.srv.Client(testutil.RandStr())
+	anon := e.srv.Client("")
+	ch, roCh := prefix+testutil.RandStr(), prefix+"ro:"+testutil.RandStr()
+
+	assertStatus := func(code int, err error) {
+		herr, ok := err.(*otter.HTTPError)
+		require.True(t, ok, "err:%v", err)
+		assert.Equal(t, code, herr.StatusCode)
+	}
+
+	require.Nil(t, client.Publish("hi", ch))
+	assertStatus(413, client.Publish("0123456789", ch))
+	assertStatus(403, client.Publish("hi", roCh))
+	assertStatus(403, anon.Publish("hi", roCh))
+
+	// anonymous connections can't subscribe to either namespace
+	anonCh := make(chan otter.Pub, 1)
+	errCh := anon.Subscribe(anonCh, e.stopCh, roCh)
+	select {
+	case <-errCh:
+	case <-time.After(1 * time.Second):
+		t.Fatal("anonymous subscribe wasn't closed")
+	}
+	_, err := anon.GetHistory(ch)
+	assertStatus(403, err)
+
+	// publishes from clients and backends are both recorded, but not ones
+	// which were refused
+	require.Nil(t, backend.Publish("foo", ch))
+	h, err := client.GetHistory(ch, roCh)
+	require.Nil(t, err)
+	require.Len(t, h[ch], 2)
+	assert.Empty(t, h[roCh])
+	for i, expected := range []string{"hi", "foo"} {
+		var msg string
+		require.Nil(t, json.Unmarshal(*h[ch][i].Message, &msg))
+		assert.Equal(t, expected, msg)
+		assert.Equal(t, i == 1, h[ch][i].Conn.IsBackend)
+	}
+}
@@ -0,0 +1,234 @@
+// Package webhook delivers connection lifecycle events, and optionally client
+// publishes, to http endpoints, so backend applications don't need to hold a
+// websocket connection open to learn about them
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/backoff"
+	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/distr"
+)
+
+// Opts describes where and how to deliver events
+type Opts struct {
+	// Every event is delivered to each of these URLs, using a POST with the
+	// json encoded Event as the body
+	URLs []string
+
+	// Used to sign each delivery's body, which can be checked with auth.Auth's
+	// VerifyRequest
+	Secret string
+
+	// If set, publishes made by clients are delivered as well as lifecycle
+	// events
+	Publishes bool
+
+	// Number of events which can be waiting to be delivered to each URL.
+	// Events which come in while a URL's queue is full are dropped for that
+	// URL. Defaults to 1000.
+	QueueSize int
+
+	// Number of times delivery of each event is attempted before giving up.
+	// Defaults to 5.
+	MaxAttempts int
+
+	// Minimum and maximum amount of time to wait between attempts. The wait
+	// time doubles after each failed attempt, and a random jitter is applied.
+	// Defaults to 100ms and 10s.
+	MinBackoff, MaxBackoff time.Duration
+
+	// Timeout for each attempt. Defaults to 5s.
+	Timeout time.Duration
+}
+
+// Event is what is delivered to each URL. Type is one of "sub", "unsub",
+// "presence" and "disconnect", or "pub" if Opts.Publishes is set. A
+// "disconnect" is sent once when a client's connection is closed, after the
+// "unsub"s for each of its channels, and has Channels set rather than Channel.
+// If the client's node dies only the "unsub"s are sent.
+type Event struct {
+	Type     string           `json:"type"`
+	Conn     conn.Conn        `json:"connection"`
+	Channel  string           `json:"channel,omitempty"`
+	Channels []string         `json:"channels,omitempty"`
+	Message  *json.RawMessage `json:"message,omitempty"`
+	Time     time.Time        `json:"time"`
+}
+
+type sender struct {
+	o         Opts
+	client    *http.Client
+	endpoints []*endpoint
+}
+
+type endpoint struct {
+	s   *sender
+	url string
+	ch  chan []byte
+}
+
+var s *sender
+
+// Init starts delivering events to the URLs in the given Opts. Until it's
+// called Send and HandlePub do nothing.
+func Init(o Opts) {
+	s = newSender(o)
+	llog.Info("delivering webhooks", llog.KV{"urls": o.URLs, "publishes": o.Publishes})
+}
+
+func newSender(o Opts) *sender {
+	if o.QueueSize == 0 {
+		o.QueueSize = 1000
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 5
+	}
+	if o.MinBackoff == 0 {
+		o.MinBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = 10 * time.Second
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 5 * time.Second
+	}
+
+	sn := &sender{
+		o:      o,
+		client: &http.Client{Timeout: o.Timeout},
+	}
+	for _, u := range o.URLs {
+		ep := &endpoint{
+			s:   sn,
+			url: u,
+			ch:  make(chan []byte, o.QueueSize),
+		}
+		sn.endpoints = append(sn.endpoints, ep)
+		go ep.spin()
+	}
+	return sn
+}
+
+// Send queues the given Event to be delivered to every URL. It never blocks. If
+// Time isn't set it's set to now.
+func Send(e Event) {
+	if s != nil {
+		s.send(e)
+	}
+}
+
+// HandlePub sends an Event for the given Pub, if it's one which should be
+// delivered. It is meant to be used as distr.PublishHook.
+func HandlePub(p distr.Pub) {
+	if s != nil {
+		s.handlePub(p)
+	}
+}
+
+func (sn *sender) handlePub(p distr.Pub) {
+	// Events are only about clients, backend applications don't care what
+	// each other are doing
+	if p.Conn.IsBackend || (p.Type == "pub" && !sn.o.Publishes) {
+		return
+	}
+	sn.send(Event{
+		Type:    p.Type,
+		Conn:    p.Conn,
+		Channel: p.Channel,
+		Message: p.Message,
+	})
+}
+
+func (sn *sender) send(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		llog.Error("error marshalling webhook event", llog.KV{"err": err})
+		return
+	}
+
+	for _, ep := range sn.endpoints {
+		select {
+		case ep.ch <- b:
+		default:
+			llog.Warn("webhook queue full, dropping event", llog.KV{
+				"url":  ep.url,
+				"type": e.Type,
+			})
+		}
+	}
+}
+
+func (ep *endpoint) spin() {
+	for b := range ep.ch {
+		ep.deliver(b)
+	}
+}
+
+// deliver attempts to deliver the given body until it succeeds, fails in a way
+// which retrying won't fix, or runs out of attempts
+func (ep *endpoint) deliver(b []byte) {
+	kv := llog.KV{"url": ep.url}
+	for attempt := 1; ; attempt++ {
+		retry, err := ep.post(b)
+		if err == nil {
+			return
+		}
+		kv["err"] = err
+		kv["attempt"] = attempt
+		if !retry || attempt >= ep.s.o.MaxAttempts {
+			llog.Error("giving up on delivering webhook", kv)
+			return
+		}
+		llog.Warn("error delivering webhook, will retry", kv)
+		time.Sleep(backoff.Duration(ep.s.o.MinBackoff, ep.s.o.MaxBackoff, uint(attempt)))
+	}
+}
+
+// post makes a single delivery attempt, returning whether it's worth retrying
+// if it fails
+func (ep *endpoint) post(b []byte) (bool, error) {
+	r, err := http.NewRequest("POST", ep.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	(auth.Auth{Key: ep.s.o.Secret}).SignRequest(r, b)
+
+	resp, err := ep.s.client.Do(r)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = &statusError{resp.StatusCode}
+	// a 4xx means the request itself is bad, so retrying won't help, except
+	// for these which are meant to be retried
+	retry := resp.StatusCode/100 != 4 ||
+		resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return "webhook endpoint responded " + http.StatusText(e.code)
+}
@@ -0,0 +1,227 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/conn"
+	"github.com/levenlabs/otter/distr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	conn.NodeID = testutil.RandStr()
+}
+
+// receiver is an http endpoint which records the events delivered to it. The
+// first failN requests it receives are responded to with failCode.
+type receiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+
+	l        sync.Mutex
+	failN    int
+	failCode int
+	reqs     int
+	ch       chan Event
+	blockCh  chan struct{}
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	r := &receiver{
+		t:      t,
+		secret: secret,
+		ch:     make(chan Event, 100),
+	}
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.blockCh != nil {
+		<-r.blockCh
+	}
+
+	r.l.Lock()
+	r.reqs++
+	fail, code := r.failN > 0, r.failCode
+	if fail {
+		r.failN--
+	}
+	r.l.Unlock()
+	if fail {
+		w.WriteHeader(code)
+		return
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	require.Nil(r.t, err)
+	assert.True(r.t, (auth.Auth{Key: r.secret}).VerifyRequest(req, b))
+
+	var e Event
+	require.Nil(r.t, json.Unmarshal(b, &e))
+	r.ch <- e
+}
+
+// fail resets the request count and causes the next n requests to fail with
+// the given code
+func (r *receiver) fail(n, code int) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.reqs = 0
+	r.failN, r.failCode = n, code
+}
+
+func (r *receiver) numReqs() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.reqs
+}
+
+func (r *receiver) next() Event {
+	select {
+	case e := <-r.ch:
+		return e
+	case <-time.After(2 * time.Second):
+		r.t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+func (r *receiver) assertNone() {
+	select {
+	case e := <-r.ch:
+		r.t.Fatalf("unexpected event: %#v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testOpts(secret string, rr ...*receiver) Opts {
+	o := Opts{
+		Secret:     secret,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+	for _, r := range rr {
+		o.URLs = append(o.URLs, r.URL)
+	}
+	return o
+}
+
+func TestSend(t *testing.T) {
+	secret := testutil.RandStr()
+	r1, r2 := newReceiver(t, secret), newReceiver(t, secret)
+	defer r1.Close()
+	defer r2.Close()
+	sn := newSender(testOpts(secret, r1, r2))
+
+	c := conn.New()
+	require.Nil(t, c.SetPresence(testutil.RandStr()))
+	chs := []string{testutil.RandStr(), testutil.RandStr()}
+	sn.send(Event{Type: "disconnect", Conn: c, Channels: chs})
+
+	for _, r := range []*receiver{r1, r2} {
+		e := r.next()
+		assert.Equal(t, "disconnect", e.Type)
+		assert.Equal(t, c, e.Conn)
+		assert.Equal(t, chs, e.Channels)
+		assert.False(t, e.Time.IsZero())
+	}
+}
+
+func TestHandlePub(t *testing.T) {
+	secret := testutil.RandStr()
+	r := newReceiver(t, secret)
+	defer r.Close()
+	sn := newSender(testOpts(secret, r))
+
+	c := conn.New()
+	ch := testutil.RandStr()
+	msg := json.RawMessage(`"foo"`)
+
+	sn.handlePub(distr.Pub{Type: "pub", Conn: c, Channel: ch, Message: &msg})
+	sn.handlePub(distr.Pub{Type: "sub", Conn: c, Channel: ch})
+	e := r.next()
+	assert.Equal(t, "sub", e.Type)
+	assert.Equal(t, c, e.Conn)
+	assert.Equal(t, ch, e.Channel)
+
+	backend := conn.New()
+	backend.IsBackend = true
+	sn.handlePub(distr.Pub{Type: "sub", Conn: backend, Channel: ch})
+	r.assertNone()
+
+	o := testOpts(secret, r)
+	o.Publishes = true
+	sn = newSender(o)
+	sn.handlePub(distr.Pub{Type: "pub", Conn: c, Channel: ch, Message: &msg})
+	e = r.next()
+	assert.Equal(t, "pub", e.Type)
+	require.NotNil(t, e.Message)
+	assert.Equal(t, msg, *e.Message)
+}
+
+func TestRetry(t *testing.T) {
+	secret := testutil.RandStr()
+	r := newReceiver(t, secret)
+	defer r.Close()
+	sn := newSender(testOpts(secret, r))
+	c := conn.New()
+
+	// retryable failures are retried until delivery succeeds
+	r.fail(3, http.StatusServiceUnavailable)
+	sn.send(Event{Type: "disconnect", Conn: c})
+	r.next()
+	assert.Equal(t, 4, r.numReqs())
+
+	// but only up to MaxAttempts
+	r.fail(sn.o.MaxAttempts, http.StatusTooManyRequests)
+	sn.send(Event{Type: "disconnect", Conn: c})
+	r.assertNone()
+	assert.Equal(t, sn.o.MaxAttempts, r.numReqs())
+
+	// and a bad request isn't retried at all
+	r.fail(1, http.StatusBadRequest)
+	sn.send(Event{Type: "disconnect", Conn: c})
+	sn.send(Event{Type: "sub", Conn: c})
+	assert.Equal(t, "sub", r.next().Type)
+	assert.Equal(t, 2, r.numReqs())
+}
+
+func TestQueues(t *testing.T) {
+	secret := testutil.RandStr()
+	blocked, ok := newReceiver(t, secret), newReceiver(t, secret)
+	blocked.blockCh = make(chan struct{})
+	defer blocked.Close()
+	defer ok.Close()
+
+	o := testOpts(secret, blocked, ok)
+	o.QueueSize = 1
+	sn := newSender(o)
+	c := conn.New()
+
+	// one event is taken off the queue and is stuck being delivered, one sits
+	// in the queue, and the rest are dropped for the blocked endpoint. The
+	// other endpoint gets all of them since it's keeping up.
+	for i := 0; i < 5; i++ {
+		sn.send(Event{Type: "sub", Conn: c})
+		ok.next()
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	close(blocked.blockCh)
+	blocked.next()
+	blocked.next()
+	blocked.assertNone()
+}
@@ -20,6 +20,11 @@ type rConn struct {
 	closeCh chan struct{}
 
 	pubCh chan distr.Pub
+
+	// written to when the connection needs to resubscribe, see
+	// resubscribeAll. Has a buffer of one, if it's full a resubscribe is
+	// already pending.
+	resubCh chan struct{}
 }
 
 var r = map[conn.ID]rConn{}
@@ -44,7 +49,7 @@ func pubReader(i int) {
 	for p := range distr.PubCh {
 		kv := llog.KV{"ch": p.Channel, "i": i}
 
-		conns, err := distr.GetSubscribed(conn.NodeID, p.Channel, !p.Conn.IsBackend, connSetTimeout)
+		conns, err := distr.GetSubscribed(conn.NodeID, p.Channel, !p.Conn.IsBackend)
 		if err != nil {
 			kv["err"] = err
 			llog.Error("error getting subscribed", kv)
@@ -67,9 +72,75 @@ func pubReader(i int) {
 	}
 }
 
+type pendingUnsub struct {
+	c   conn.Conn
+	chs []string
+}
+
+// unsubscribes (and conn info removals) which failed during connection
+// teardown. These are retried by cleanup, since nothing else will ever remove
+// them while this node is alive
+var pendingUnsubs []pendingUnsub
+var pendingUnsubsLock sync.Mutex
+
+func retryUnsub(c conn.Conn, chs []string) {
+	pendingUnsubsLock.Lock()
+	pendingUnsubs = append(pendingUnsubs, pendingUnsub{c: c, chs: chs})
+	pendingUnsubsLock.Unlock()
+}
+
+func flushPendingUnsubs() {
+	pendingUnsubsLock.Lock()
+	pp := pendingUnsubs
+	pendingUnsubs = nil
+	pendingUnsubsLock.Unlock()
+
+	for _, p := range pp {
+		err := distr.Unsubscribe(p.c, p.chs...)
+		if err == nil {
+			err = distr.RemoveConnInfo(p.c)
+		}
+		if err != nil {
+			llog.Error("error retrying unsub", llog.KV{
+				"id":   p.c.ID,
+				"subs": p.chs,
+				"err":  err,
+			})
+			retryUnsub(p.c, p.chs)
+		}
+	}
+}
+
+// resubscribeAll tells every connection on this node to resubscribe. Each
+// connection does so itself, since its Conn may change while it's alive.
+func resubscribeAll() {
+	rlock.RLock()
+	defer rlock.RUnlock()
+	for _, rc := range r {
+		select {
+		case rc.resubCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func cleanup() {
-	for range time.Tick(connSetTimeout / 2) {
-		distr.CleanChannels(false, connSetTimeout)
-		distr.CleanChannels(true, connSetTimeout)
+	heartbeatTick := time.NewTicker(nodeTimeout / 4)
+	cleanTick := time.NewTicker(nodeTimeout / 2)
+	for {
+		select {
+		case <-heartbeatTick.C:
+			if cleaned, err := distr.Heartbeat(); err != nil {
+				llog.Error("error sending heartbeat", llog.KV{"err": err})
+			} else if cleaned {
+				llog.Warn("this node was cleaned up as dead, resubscribing all connections", nil)
+				resubscribeAll()
+			}
+		case <-cleanTick.C:
+			flushPendingUnsubs()
+			distr.CleanChannels(false)
+			distr.CleanChannels(true)
+			distr.CleanDeadNodes(nodeTimeout)
+		}
 	}
 }
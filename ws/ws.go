@@ -11,18 +11,28 @@ import (
 
 	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/otter/auth"
+	"github.com/levenlabs/otter/authz"
 	"github.com/levenlabs/otter/conn"
 	"github.com/levenlabs/otter/distr"
+	"github.com/levenlabs/otter/namespace"
+	"github.com/levenlabs/otter/webhook"
 	"golang.org/x/net/websocket"
 )
 
-var connSetTimeout = 30 * time.Second
+// nodeTimeout is how long a node can go without sending a heartbeat before it's
+// considered dead and its connections are cleaned up
+var nodeTimeout = 30 * time.Second
 
 // Auth needs to be set in order to properly handle authentication
 var Auth auth.Auth
 
+// Errors which may be returned to clients
 var (
-	errInvalidSig = errors.New("invalid signature")
+	ErrInvalidSig       = errors.New("invalid signature")
+	ErrInvalidPresence  = errors.New("invalid presence json")
+	ErrForbidden        = errors.New("not allowed")
+	ErrNotFound         = errors.New("not found")
+	ErrPresenceRequired = errors.New("presence required")
 )
 
 // Init initializes connection routing
@@ -37,11 +47,17 @@ func NewHandler() http.Handler {
 		if r.URL.Path == "" {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
-		} else if r.URL.Path[0] == '/' {
-			r.URL.Path = r.URL.Path[1:]
 		}
 
-		if r.Method == "POST" {
+		if pp := strings.SplitN(reqPath(r), "/", 2); pp[0] == APIPrefix {
+			if r.Method != "GET" {
+				http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+			} else if len(pp) == 2 {
+				apiHandler(w, r, pp[1])
+			} else {
+				http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			}
+		} else if r.Method == "POST" {
 			pubHandler(w, r)
 		} else if r.Method == "GET" {
 			getHandler(w, r)
@@ -51,8 +67,20 @@ func NewHandler() http.Handler {
 	})
 }
 
+// APIPrefix is used in place of the list of channels for endpoints which aren't
+// about particular channels, e.g. "_/channels". It therefore can't be used as a
+// channel name.
+const APIPrefix = "_"
+
+// reqPath returns the request's path without its leading slash. The request's
+// URL itself isn't modified, since the websocket handshake uses it to determine
+// the connection's location.
+func reqPath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/")
+}
+
 func getConnInfo(r *http.Request) (conn.Conn, []string, error) {
-	p := strings.SplitN(r.URL.Path, "/", 2)[0]
+	p := strings.SplitN(reqPath(r), "/", 2)[0]
 	subs := strings.Split(p, ",")
 	subsF := subs[:0]
 	for _, sub := range subs {
@@ -64,14 +92,14 @@ func getConnInfo(r *http.Request) (conn.Conn, []string, error) {
 	c := conn.New()
 	presence, sig := r.FormValue("presence"), r.FormValue("sig")
 	if presence != "" && !Auth.Verify(sig, presence) {
-		return c, subs, errInvalidSig
+		return c, subsF, ErrInvalidSig
 	}
 	if presence == "backend" {
 		c.IsBackend = true
-	} else if presence != "" {
-		c.Presence = presence
+	} else if err := c.SetPresence(presence); err != nil {
+		return c, subsF, ErrInvalidPresence
 	}
-	return c, subs, nil
+	return c, subsF, nil
 }
 
 func pubHandler(w http.ResponseWriter, r *http.Request) {
@@ -87,6 +115,13 @@ func pubHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, ch := range subs {
+		if err := authorizePub(c, ch); err != nil {
+			authError(w, err)
+			return
+		}
+	}
+
 	for _, ch := range subs {
 		err := distr.Publish(distr.Pub{
 			Type:    "pub",
@@ -94,51 +129,324 @@ func pubHandler(w http.ResponseWriter, r *http.Request) {
 			Channel: ch,
 			Message: &msg,
 		})
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+		if err == distr.ErrMessageTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			llog.Error("publish failed", llog.KV{
-				"presence": c.Presence,
+				"presence": presenceKV(c),
 				"channel":  ch,
 				"err":      err,
 			})
+			return
 		}
 	}
 }
 
-func listSubbed(chs ...string) ([]conn.Conn, error) {
-	nIDs, err := distr.GetNodeIDs()
-	if err != nil {
-		return nil, err
+// authorizeSub returns ErrForbidden if the given Conn may not subscribe to the
+// given channel, based on the channel's namespace and the authz callback. Other
+// errors indicate the callback failed.
+func authorizeSub(c conn.Conn, ch string) error {
+	if !c.IsBackend && c.PresenceKey() == "" && !namespace.Get(ch).AnonymousSubscribe {
+		return ErrForbidden
+	}
+	if ok, err := authz.Authorize(authz.ActionSub, c, ch); err != nil {
+		return err
+	} else if !ok {
+		return ErrForbidden
 	}
+	return nil
+}
 
-	m := map[conn.Conn]struct{}{}
-	for _, nID := range nIDs {
-		for _, ch := range chs {
-			cc, err := distr.GetSubscribed(nID, ch, false, connSetTimeout)
+// authorizePub is like authorizeSub but for publishing. The size of the
+// message is checked by distr.Publish.
+func authorizePub(c conn.Conn, ch string) error {
+	if !c.IsBackend && !namespace.Get(ch).ClientPublish {
+		return ErrForbidden
+	}
+	if ok, err := authz.Authorize(authz.ActionPub, c, ch); err != nil {
+		return err
+	} else if !ok {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authError writes the given error from authorizeSub or authorizePub with the
+// appropriate status code
+func authError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// presenceKV returns the presence of the given Conn in a form suitable for
+// logging
+func presenceKV(c conn.Conn) interface{} {
+	if c.PresenceFields != nil {
+		return c.PresenceFields
+	}
+	return c.Presence
+}
+
+// presenceFilterPrefix prefixes query parameters which filter listings by
+// presence fields, e.g. "presence.user.id=123"
+const presenceFilterPrefix = "presence."
+
+func presenceFilter(r *http.Request) map[string]string {
+	filter := map[string]string{}
+	for k, vv := range r.URL.Query() {
+		if strings.HasPrefix(k, presenceFilterPrefix) && len(vv) > 0 {
+			filter[strings.TrimPrefix(k, presenceFilterPrefix)] = vv[0]
+		}
+	}
+	return filter
+}
+
+// SubListEntry describes a single connection in a listing, along with which
+// of the listed channels it is subscribed to
+type SubListEntry struct {
+	Conn     conn.Conn `json:"connection"`
+	Channels []string  `json:"channels"`
+}
+
+// subbedPageSize is how many connections are retrieved from a channel's set at
+// a time when listing them
+var subbedPageSize = 500
+
+// forEachSubbedNode calls fn with every connection on the given node subscribed
+// to any of the given channels whose presence matches the given filter, see
+// conn.Conn.MatchesPresence. Since a connection only ever lives on one node,
+// each entry has all of the given channels its connection is subscribed to.
+// Connections are retrieved a page at a time, so only one page is held in
+// memory at once.
+func forEachSubbedNode(nodeID string, filter map[string]string, chs []string, fn func(SubListEntry) error) error {
+	for i, ch := range chs {
+		for offset := 0; ; offset += subbedPageSize {
+			cc, err := distr.GetSubscribedPage(nodeID, ch, false, offset, subbedPageSize)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			for _, c := range cc {
-				m[c] = struct{}{}
+			if err := subbedPage(nodeID, filter, chs, i, cc, fn); err != nil {
+				return err
 			}
+			if len(cc) < subbedPageSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// subbedPage calls fn with each of the given connections, which were retrieved
+// from the set of chs[i], along with the rest of chs they are subscribed to.
+// Connections subscribed to any channel before chs[i] are skipped, since they
+// were already given to fn when that channel was paged through.
+func subbedPage(nodeID string, filter map[string]string, chs []string, i int, cc []conn.Conn, fn func(SubListEntry) error) error {
+	var matched []conn.Conn
+	for _, c := range cc {
+		if c.MatchesPresence(filter) {
+			matched = append(matched, c)
+		}
+	}
+
+	var subbedTo [][]bool
+	if len(chs) > 1 && len(matched) > 0 {
+		var err error
+		if subbedTo, err = distr.SubscribedTo(nodeID, matched, chs); err != nil {
+			return err
 		}
 	}
 
-	res := make([]conn.Conn, 0, len(m))
-	for c := range m {
-		res = append(res, c)
+outer:
+	for ci, c := range matched {
+		e := SubListEntry{Conn: c}
+		for j, ch := range chs {
+			if j != i && (subbedTo == nil || !subbedTo[ci][j]) {
+				continue
+			}
+			if j < i {
+				continue outer
+			}
+			e.Channels = append(e.Channels, ch)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listSubbed returns the entries forEachSubbedNode would give for every node
+func listSubbed(filter map[string]string, chs ...string) ([]SubListEntry, error) {
+	nIDs, err := distr.GetNodeIDs(nodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []SubListEntry
+	for _, nID := range nIDs {
+		err := forEachSubbedNode(nID, filter, chs, func(e SubListEntry) error {
+			res = append(res, e)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 	return res, nil
 }
 
+// StreamEnd is written as the final line of a successful /subbed stream, so
+// that clients can tell a complete stream from one which was cut off
+type StreamEnd struct {
+	Done bool `json:"done"`
+}
+
+// streamSubbed is like listSubbed, but writes each entry to the given
+// ResponseWriter as newline delimited json as it goes, rather than returning
+// them all at once, and finishes with a StreamEnd line. Since the response has
+// already been started, an error encountered part way through is written as a
+// final line of the form {"error":"..."} instead.
+func streamSubbed(w http.ResponseWriter, filter map[string]string, chs ...string) error {
+	nIDs, err := distr.GetNodeIDs(nodeTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for _, nID := range nIDs {
+		var encErr error
+		err := forEachSubbedNode(nID, filter, chs, func(e SubListEntry) error {
+			encErr = enc.Encode(e)
+			return encErr
+		})
+		if encErr != nil {
+			return encErr
+		} else if err != nil {
+			enc.Encode(struct {
+				Error string `json:"error"`
+			}{err.Error()})
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return enc.Encode(StreamEnd{Done: true})
+}
+
 // SubListRes is the structur that the list of connection objects from a call to
 // /subbed will be returned in
 type SubListRes struct {
 	Conns []conn.Conn `json:"conns"`
+
+	// The channels each connection is subscribed to, keyed by connection ID
+	Channels map[conn.ID][]string `json:"channels"`
+}
+
+// SubCount describes how many clients are subscribed to a channel
+type SubCount struct {
+	Conns int `json:"conns"`
+
+	// Number of distinct presences amongst the clients, not counting clients
+	// with no presence. Only filled in if requested.
+	Presences *int `json:"presences,omitempty"`
+}
+
+// SubCountRes is the structure that the counts from a call to /count will be
+// returned in, keyed by channel
+type SubCountRes struct {
+	Counts map[string]SubCount `json:"counts"`
+}
+
+// countSubbed returns the number of clients subscribed to each of the given
+// channels. Counting distinct presences requires retrieving every distinct
+// presence on each node, so is only done if presences is true.
+func countSubbed(presences bool, chs ...string) (map[string]SubCount, error) {
+	nIDs, err := distr.GetNodeIDs(nodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]SubCount, len(chs))
+	for _, ch := range chs {
+		var sc SubCount
+		for _, nID := range nIDs {
+			n, err := distr.CountSubscribed(nID, ch, false)
+			if err != nil {
+				return nil, err
+			}
+			sc.Conns += n
+		}
+
+		if presences {
+			pm := map[string]struct{}{}
+			for _, nID := range nIDs {
+				pks, err := distr.GetSubscribedPresences(nID, ch)
+				if err != nil {
+					return nil, err
+				}
+				for _, pk := range pks {
+					pm[pk] = struct{}{}
+				}
+			}
+			n := len(pm)
+			sc.Presences = &n
+		}
+
+		m[ch] = sc
+	}
+	return m, nil
+}
+
+// listChannels returns all channels which have clients subscribed to them,
+// across all nodes, along with the number of clients subscribed. If prefix is
+// not empty only channels starting with it are returned.
+func listChannels(prefix string) (map[string]SubCount, error) {
+	nIDs, err := distr.GetNodeIDs(nodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]SubCount{}
+	for _, nID := range nIDs {
+		counts, err := distr.GetChannelCounts(nID, false, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for ch, n := range counts {
+			sc := m[ch]
+			sc.Conns += n
+			m[ch] = sc
+		}
+	}
+	return m, nil
+}
+
+// backendConnInfo is like getConnInfo, but writes an error and returns false if
+// the request isn't from a backend application
+func backendConnInfo(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	c, subs, err := getConnInfo(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	} else if !c.IsBackend {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return subs, true
 }
 
 func getHandler(w http.ResponseWriter, r *http.Request) {
-	pp := strings.SplitN(r.URL.Path, "/", 2)
+	pp := strings.SplitN(reqPath(r), "/", 2)
 	var suffix string
 	if len(pp) == 2 {
 		suffix = pp[1]
@@ -148,31 +456,199 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 		(websocket.Server{Handler: handler}).ServeHTTP(w, r)
 
 	} else if suffix == "subbed" {
-		cc, subs, err := getConnInfo(r)
+		subs, ok := backendConnInfo(w, r)
+		if !ok {
+			return
+		}
+
+		filter := presenceFilter(r)
+		if r.FormValue("stream") == "true" {
+			if err := streamSubbed(w, filter, subs...); err != nil {
+				llog.Error("error streaming subbed connections", llog.KV{"subs": subs, "err": err})
+			}
+			return
+		}
+
+		ee, err := listSubbed(filter, subs...)
+		if err != nil {
+			llog.Error("error getting subbed connections", llog.KV{"subs": subs, "err": err})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res := SubListRes{
+			Conns:    make([]conn.Conn, len(ee)),
+			Channels: make(map[conn.ID][]string, len(ee)),
+		}
+		for i, e := range ee {
+			res.Conns[i] = e.Conn
+			res.Channels[e.Conn.ID] = e.Channels
+		}
+		json.NewEncoder(w).Encode(res)
+
+	} else if suffix == "count" {
+		subs, ok := backendConnInfo(w, r)
+		if !ok {
+			return
+		}
+
+		presences := r.FormValue("presences") == "true"
+		counts, err := countSubbed(presences, subs...)
+		if err != nil {
+			llog.Error("error counting subbed connections", llog.KV{"subs": subs, "err": err})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(SubCountRes{Counts: counts})
+
+	} else if suffix == "history" {
+		c, subs, err := getConnInfo(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
-		} else if !cc.IsBackend {
-			http.Error(w, "not allowed", http.StatusForbidden)
 		}
 
-		conns, err := listSubbed(subs...)
+		res := HistoryRes{History: make(map[string][]distr.Pub, len(subs))}
+		for _, ch := range subs {
+			if err := authorizeSub(c, ch); err != nil {
+				authError(w, err)
+				return
+			}
+			pp, err := distr.GetHistory(ch)
+			if err != nil {
+				llog.Error("error getting history", llog.KV{"channel": ch, "err": err})
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.History[ch] = pp
+		}
+
+		json.NewEncoder(w).Encode(res)
+
+	} else {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+	}
+}
+
+// apiHandler handles the given endpoint under APIPrefix. These are all only
+// available to backend applications.
+func apiHandler(w http.ResponseWriter, r *http.Request, endpoint string) {
+	if _, ok := backendConnInfo(w, r); !ok {
+		return
+	}
+
+	if endpoint == "channels" {
+		counts, err := listChannels(r.FormValue("prefix"))
+		if err != nil {
+			llog.Error("error listing channels", llog.KV{"err": err})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(SubCountRes{Counts: counts})
+
+	} else if endpoint == "conn" {
+		id := conn.ID(r.FormValue("id"))
+		ci, ok, err := lookupConn(id)
 		if err != nil {
-			llog.Error("error getting subbed connections", llog.KV{"subs": subs, "err": err})
-			http.Error(w, err.Error(), http.StatusForbidden)
+			llog.Error("error getting conn info", llog.KV{"connID": id, "err": err})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			return
 		}
 
-		json.NewEncoder(w).Encode(SubListRes{Conns: conns})
+		json.NewEncoder(w).Encode(ci)
+
+	} else if endpoint == "conns" {
+		var c conn.Conn
+		if err := c.SetPresence(r.FormValue("withPresence")); err != nil {
+			http.Error(w, ErrInvalidPresence.Error(), http.StatusBadRequest)
+			return
+		} else if c.PresenceKey() == "" {
+			http.Error(w, "withPresence required", http.StatusBadRequest)
+			return
+		}
+
+		cis, err := findConns(c.PresenceKey())
+		if err != nil {
+			llog.Error("error finding conns by presence", llog.KV{"err": err})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(ConnInfoListRes{Conns: cis})
+
+	} else {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
 	}
 }
 
+// HistoryRes is the structure that the recorded publishes from a call to
+// /history will be returned in, keyed by channel
+type HistoryRes struct {
+	History map[string][]distr.Pub `json:"history"`
+}
+
+// ConnInfoListRes is the structure that the list of connections from a call to
+// /conns will be returned in
+type ConnInfoListRes struct {
+	Conns []distr.ConnInfo `json:"conns"`
+}
+
+// lookupConn returns the info for the connection with the given ID, as long as
+// the connection's node is alive
+func lookupConn(id conn.ID) (distr.ConnInfo, bool, error) {
+	nIDs, err := distr.GetNodeIDs(nodeTimeout)
+	if err != nil {
+		return distr.ConnInfo{}, false, err
+	}
+	var alive bool
+	for _, nID := range nIDs {
+		if nID == id.NodeID() {
+			alive = true
+			break
+		}
+	}
+	if !alive {
+		return distr.ConnInfo{}, false, nil
+	}
+	return distr.GetConnInfo(id)
+}
+
+// findConns returns the info for all connections with the given presence key,
+// see conn.Conn.PresenceKey, across all nodes
+func findConns(presenceKey string) ([]distr.ConnInfo, error) {
+	nIDs, err := distr.GetNodeIDs(nodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []distr.ConnInfo{}
+	for _, nID := range nIDs {
+		cis, err := distr.GetConnInfosByPresence(nID, presenceKey)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cis...)
+	}
+	return res, nil
+}
+
 type wsConn struct {
 	conn.Conn
 	rConn
 	c           *websocket.Conn
 	enc         *json.Encoder
 	subs        []string
+	since       time.Time
 	connCloseCh chan struct{}
+
+	// PresenceUpdates read by readSpin are handed to spin, so that only one
+	// go-routine ever writes to the connection or changes the Conn
+	presenceCh chan PresenceUpdate
 }
 
 func newWSConn(c *websocket.Conn) (wsConn, error) {
@@ -180,10 +656,12 @@ func newWSConn(c *websocket.Conn) (wsConn, error) {
 		rConn: rConn{
 			closeCh: make(chan struct{}),
 			pubCh:   make(chan distr.Pub, 10),
+			resubCh: make(chan struct{}, 1),
 		},
 		c:           c,
 		enc:         json.NewEncoder(c),
 		connCloseCh: make(chan struct{}),
+		presenceCh:  make(chan PresenceUpdate),
 	}
 
 	cc, subs, err := getConnInfo(c.Request())
@@ -219,30 +697,56 @@ func handler(c *websocket.Conn) {
 	}()
 
 	for _, ch := range ws.subs {
-		kv := llog.KV{"channel": ch}
-		if err := distr.Subscribe(ws.Conn, ch); err != nil {
-			ws.writeError("error subscribing (init)", err, kv)
+		if err := authorizeSub(ws.Conn, ch); err != nil {
+			ws.writeError("error authorizing subscribe", err, llog.KV{"channel": ch})
 			return
 		}
+	}
+
+	ws.since = time.Now()
+	if err := ws.addConnInfo(); err != nil {
+		ws.writeError("error adding conn info", err, nil)
+		return
+	}
+
+	if err := distr.Subscribe(ws.Conn, ws.subs...); err != nil {
+		ws.writeError("error subscribing (init)", err, nil)
+		// some of the channels may have been subscribed to before the error
+		retryUnsub(ws.Conn, ws.subs)
+		return
+	}
+	if err := distr.AddInterest(ws.subs...); err != nil {
+		// the interest is still recorded, and will be subscribed to once
+		// whatever is wrong is fixed, so the connection can carry on
+		ws.log(llog.Warn, "error adding interest", llog.KV{"err": err})
+	}
+	defer distr.RemoveInterest(ws.subs...)
+	for _, ch := range ws.subs {
 		if err := distr.Publish(distr.Pub{
 			Type:    "sub",
 			Conn:    ws.Conn,
 			Channel: ch,
 		}); err != nil {
-			ws.writeError("error publishing subscribe", err, kv)
+			ws.writeError("error publishing subscribe", err, llog.KV{"channel": ch})
+			retryUnsub(ws.Conn, ws.subs)
 			return
 		}
 	}
 
 	ws.spin()
 
+	if err := distr.Unsubscribe(ws.Conn, ws.subs...); err != nil {
+		ws.log(llog.Error, "error unsubbing during teardown, will retry", llog.KV{
+			"err": err,
+		})
+		retryUnsub(ws.Conn, ws.subs)
+	} else if err := distr.RemoveConnInfo(ws.Conn); err != nil {
+		ws.log(llog.Error, "error removing conn info during teardown, will retry", llog.KV{
+			"err": err,
+		})
+		retryUnsub(ws.Conn, nil)
+	}
 	for _, ch := range ws.subs {
-		if err := distr.Unsubscribe(ws.Conn, ch); err != nil {
-			ws.log(llog.Error, "error unsubbing during teardown", llog.KV{
-				"channel": ch,
-				"err":     err,
-			})
-		}
 		if err := distr.Publish(distr.Pub{
 			Type:    "unsub",
 			Conn:    ws.Conn,
@@ -254,28 +758,36 @@ func handler(c *websocket.Conn) {
 			})
 		}
 	}
+	if !ws.Conn.IsBackend {
+		webhook.Send(webhook.Event{
+			Type:     "disconnect",
+			Conn:     ws.Conn,
+			Channels: ws.subs,
+		})
+	}
 }
 
 func (ws *wsConn) spin() {
 	go ws.readSpin()
-	connSetTick := time.NewTicker(connSetTimeout / 4)
-	defer connSetTick.Stop()
 
 	for {
 		select {
-		case <-connSetTick.C:
-			for _, ch := range ws.subs {
-				if err := distr.Subscribe(ws.Conn, ch); err != nil {
-					ws.log(llog.Error, "error re-subscribing conn", llog.KV{
-						"err":     err,
-						"channel": ch,
-					})
-				}
-			}
-
 		case p := <-ws.rConn.pubCh:
 			ws.enc.Encode(p)
 
+		case pu := <-ws.presenceCh:
+			if err := ws.updatePresence(pu); err != nil {
+				ws.writeError("error updating presence", err, nil)
+			}
+
+		case <-ws.resubCh:
+			if err := ws.resubscribe(); err != nil {
+				// the connection won't receive anything if it isn't
+				// subscribed, better to have the client reconnect
+				ws.writeError("error resubscribing", err, nil)
+				return
+			}
+
 		case <-ws.connCloseCh:
 			return
 		}
@@ -283,20 +795,115 @@ func (ws *wsConn) spin() {
 
 }
 
-// This is only used to determine if the connection has died, we don't actually
-// ever read anything from the client
+func (ws *wsConn) addConnInfo() error {
+	return distr.AddConnInfo(distr.ConnInfo{
+		Conn:       ws.Conn,
+		Channels:   ws.subs,
+		Since:      ws.since,
+		RemoteAddr: ws.c.Request().RemoteAddr,
+	})
+}
+
+// resubscribe adds back everything about the connection after this node has
+// been cleaned up as dead, see distr.Heartbeat. Since backend applications
+// will have been sent unsubs, subs are sent again.
+func (ws *wsConn) resubscribe() error {
+	if err := ws.addConnInfo(); err != nil {
+		return err
+	} else if err := distr.Subscribe(ws.Conn, ws.subs...); err != nil {
+		return err
+	}
+	for _, ch := range ws.subs {
+		if err := distr.Publish(distr.Pub{
+			Type:    "sub",
+			Conn:    ws.Conn,
+			Channel: ch,
+		}); err != nil {
+			return err
+		}
+	}
+	ws.log(llog.Info, "resubscribed", nil)
+	return nil
+}
+
+// PresenceUpdate can be sent by a client over its connection to change its
+// presence without reconnecting. Sig must be a signature of Presence, as when
+// connecting. Subscribed backend applications are sent a "presence" Pub for
+// each of the client's channels.
+type PresenceUpdate struct {
+	Presence string `json:"presence"`
+	Sig      string `json:"sig"`
+}
+
+// readSpin reads PresenceUpdates sent by the client and passes them to spin,
+// and is also used to determine if the connection has died. Any other messages
+// the client sends, e.g. keepalives, are ignored.
 func (ws *wsConn) readSpin() {
 	defer func() { close(ws.connCloseCh) }()
 
-	b := make([]byte, 1)
 	for {
-		_, err := ws.c.Read(b)
+		var b []byte
+		err := websocket.Message.Receive(ws.c, &b)
 		if nerr, ok := err.(*net.OpError); ok && nerr.Timeout() {
 			continue
 		} else if err != nil {
 			return
 		}
+
+		var msg struct {
+			Presence *string `json:"presence"`
+			Sig      string  `json:"sig"`
+		}
+		if err := json.Unmarshal(b, &msg); err != nil || msg.Presence == nil {
+			continue
+		}
+		select {
+		case ws.presenceCh <- PresenceUpdate{Presence: *msg.Presence, Sig: msg.Sig}:
+		case <-ws.closeCh:
+			// spin may have given up on the connection
+			return
+		}
+	}
+}
+
+// updatePresence changes the connection's presence. Since subscribing may have
+// depended on the old presence, the connection must still be allowed to
+// subscribe to all of its channels with the new one. For the same reason the
+// presence can't be removed.
+func (ws *wsConn) updatePresence(pu PresenceUpdate) error {
+	if ws.IsBackend || pu.Presence == "backend" {
+		return ErrForbidden
+	} else if pu.Presence == "" {
+		return ErrPresenceRequired
+	} else if !Auth.Verify(pu.Sig, pu.Presence) {
+		return ErrInvalidSig
+	}
+
+	newConn := conn.Conn{ID: ws.ID}
+	if err := newConn.SetPresence(pu.Presence); err != nil {
+		return ErrInvalidPresence
+	}
+	for _, ch := range ws.subs {
+		if err := authorizeSub(newConn, ch); err != nil {
+			return err
+		}
+	}
+	if err := distr.UpdateConn(ws.Conn, newConn, ws.subs...); err != nil {
+		return err
+	}
+	ws.Conn = newConn
+	ws.log(llog.Debug, "presence updated", nil)
+
+	for _, ch := range ws.subs {
+		if err := distr.Publish(distr.Pub{
+			Type:    "presence",
+			Conn:    ws.Conn,
+			Channel: ch,
+		}); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (ws *wsConn) log(fn llog.LogFunc, msg string, kv llog.KV) {
@@ -305,8 +912,8 @@ func (ws *wsConn) log(fn llog.LogFunc, msg string, kv llog.KV) {
 		"subs":       ws.subs,
 		"remoteAddr": ws.c.Request().RemoteAddr,
 	}
-	if ws.Presence != "" {
-		akv["presence"] = ws.Presence
+	if ws.Presence != "" || ws.PresenceFields != nil {
+		akv["presence"] = presenceKV(ws.Conn)
 	}
 	for k, v := range kv {
 		akv[k] = v
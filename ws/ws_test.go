@@ -24,7 +24,11 @@ func init() {
 	llog.SetLevel(llog.DebugLevel)
 	conn.NodeID = testutil.RandStr()
 
-	distr.Init("127.0.0.1:6379", 1, 3)
+	distr.Init(distr.Opts{
+		Addr:        "127.0.0.1:6379",
+		PoolSize:    1,
+		NumSubConns: 3,
+	})
 	Init(testutil.RandStr(), 3)
 
 	srv := httptest.NewServer(NewHandler())
@@ -87,6 +91,7 @@ func requireRcv(t *T, c *websocket.Conn, i interface{}) {
 
 func requireNoRcv(t *T, c *websocket.Conn) {
 	c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	defer c.SetDeadline(time.Time{})
 	err := websocket.JSON.Receive(c, nil)
 	assert.True(t, err.(*net.OpError).Timeout())
 }
@@ -200,3 +205,236 @@ func TestPubSubUnsub(t *T) {
 	requireRcv(t, c2, &p2)
 	assertPubEqual("pub", prb, msg, p2)
 }
+
+func TestListErrors(t *T) {
+	ch := testutil.RandStr()
+
+	resp, err := http.Get(makeTestURL("http", testutil.RandStr(), "subbed", ch))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	u := makeTestURL("http", "backend", "subbed", ch)
+	u = strings.Replace(u, "presence=backend", "presence=notbackend", 1)
+	resp, err = http.Get(u)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPresenceFields(t *T) {
+	ch := testutil.RandStr()
+	id := testutil.RandStr()
+	presence := `{"user":{"id":"` + id + `"}}`
+
+	u := makeTestURL("ws", presence, "", ch)
+	c, err := websocket.Dial(u, "", u)
+	require.Nil(t, err)
+	defer c.Close()
+	u = makeTestURL("ws", `{"user":{"id":"`+testutil.RandStr()+`"}}`, "", ch)
+	c2, err := websocket.Dial(u, "", u)
+	require.Nil(t, err)
+	defer c2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	u = makeTestURL("http", "backend", "subbed", ch) + "&presence.user.id=" + id
+	resp, err := http.Get(u)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var res SubListRes
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Len(t, res.Conns, 1)
+	assert.Empty(t, res.Conns[0].Presence)
+	v, _ := res.Conns[0].PresenceFields.Get("user.id")
+	assert.Equal(t, id, v)
+
+	resp, err = http.Get(makeTestURL("http", `{"user":`, "subbed", ch))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPresenceUpdate(t *T) {
+	ch := testutil.RandStr()
+	cb, _ := testConn(true, ch)
+	defer cb.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	c, pr := testConn(false, ch)
+	defer c.Close()
+	var p distr.Pub
+	requireRcv(t, cb, &p)
+	assert.Equal(t, "sub", p.Type)
+	assert.Equal(t, pr, p.Conn.Presence)
+	id := p.Conn.ID
+
+	pr2 := `{"away":true}`
+	require.Nil(t, websocket.JSON.Send(c, PresenceUpdate{
+		Presence: pr2,
+		Sig:      Auth.Sign(pr2),
+	}))
+	p = distr.Pub{}
+	requireRcv(t, cb, &p)
+	assert.Equal(t, "presence", p.Type)
+	assert.Equal(t, ch, p.Channel)
+	assert.Equal(t, id, p.Conn.ID)
+	assert.Empty(t, p.Conn.Presence)
+	assert.Equal(t, true, p.Conn.PresenceFields["away"])
+
+	l, err := listSubbed(nil, ch)
+	require.Nil(t, err)
+	require.Len(t, l, 1)
+	assert.Equal(t, p.Conn, l[0].Conn)
+
+	// messages which aren't presence updates are ignored
+	require.Nil(t, websocket.Message.Send(c, "ping"))
+	require.Nil(t, websocket.Message.Send(c, `{"foo":"bar"}`))
+	requireNoRcv(t, c)
+
+	// neither should removing the presence
+	require.Nil(t, websocket.JSON.Send(c, PresenceUpdate{}))
+	var e struct{ Error interface{} }
+	requireRcv(t, c, &e)
+	requireNoRcv(t, cb)
+
+	// or a bad signature
+	require.Nil(t, websocket.JSON.Send(c, PresenceUpdate{
+		Presence: testutil.RandStr(),
+		Sig:      "bad",
+	}))
+	requireRcv(t, c, &e)
+	requireNoRcv(t, cb)
+	l, err = listSubbed(nil, ch)
+	require.Nil(t, err)
+	require.Len(t, l, 1)
+	assert.Equal(t, p.Conn, l[0].Conn)
+}
+
+func TestResubscribe(t *T) {
+	ch := testutil.RandStr()
+	cb, _ := testConn(true, ch)
+	defer cb.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	c, _ := testConn(false, ch)
+	defer c.Close()
+	var p distr.Pub
+	requireRcv(t, cb, &p)
+	assert.Equal(t, "sub", p.Type)
+
+	// simulate this node having been cleaned up as dead
+	require.Nil(t, distr.Unsubscribe(p.Conn, ch))
+	require.Nil(t, distr.RemoveConnInfo(p.Conn))
+	l, err := listSubbed(nil, ch)
+	require.Nil(t, err)
+	assert.Empty(t, l)
+
+	resubscribeAll()
+	p2 := distr.Pub{}
+	requireRcv(t, cb, &p2)
+	assert.Equal(t, p, p2)
+
+	l, err = listSubbed(nil, ch)
+	require.Nil(t, err)
+	require.Len(t, l, 1)
+	assert.Equal(t, p.Conn, l[0].Conn)
+	_, ok, err := distr.GetConnInfo(p.Conn.ID)
+	require.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestCount(t *T) {
+	ch := testutil.RandStr()
+	c1, _ := testConn(false, ch)
+	defer c1.Close()
+	c2, _ := testConn(false, ch)
+	defer c2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(makeTestURL("http", "backend", "count", ch) + "&presences=true")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var res SubCountRes
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, 2, res.Counts[ch].Conns)
+	require.NotNil(t, res.Counts[ch].Presences)
+	assert.Equal(t, 2, *res.Counts[ch].Presences)
+
+	resp2, err := http.Get(makeTestURL("http", testutil.RandStr(), "count", ch))
+	require.Nil(t, err)
+	resp2.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp2.StatusCode)
+}
+
+func TestListSubbed(t *T) {
+	ch, ch2 := testutil.RandStr(), testutil.RandStr()
+	c1, _ := testConn(false, ch, ch2)
+	defer c1.Close()
+	c2, _ := testConn(false, ch2)
+	defer c2.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// make sure connections are only listed once even when they're spread
+	// across pages of different channels
+	defer func(n int) { subbedPageSize = n }(subbedPageSize)
+	subbedPageSize = 1
+
+	resp, err := http.Get(makeTestURL("http", "backend", "subbed", ch, ch2))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var res SubListRes
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Len(t, res.Conns, 2)
+	for _, c := range res.Conns {
+		assert.Contains(t, [][]string{{ch, ch2}, {ch2}}, res.Channels[c.ID])
+	}
+
+	resp2, err := http.Get(makeTestURL("http", "backend", "subbed", ch, ch2) + "&stream=true")
+	require.Nil(t, err)
+	defer resp2.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp2.Header.Get("Content-Type"))
+	dec := json.NewDecoder(resp2.Body)
+	var ee []SubListEntry
+	for {
+		var e struct {
+			SubListEntry
+			StreamEnd
+		}
+		require.Nil(t, dec.Decode(&e))
+		if e.Done {
+			break
+		}
+		ee = append(ee, e.SubListEntry)
+	}
+	assert.False(t, dec.More())
+	require.Len(t, ee, 2)
+	for _, e := range ee {
+		assert.Equal(t, res.Channels[e.Conn.ID], e.Channels)
+	}
+}
+
+func TestEnumerateChannels(t *T) {
+	prefix := testutil.RandStr()
+	ch := prefix + testutil.RandStr()
+	c, _ := testConn(false, ch)
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(makeTestURL("http", "backend", "channels", APIPrefix) + "&prefix=" + prefix)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var res SubCountRes
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, map[string]SubCount{ch: {Conns: 1}}, res.Counts)
+
+	// the endpoint isn't about any channel, so isn't available for one
+	resp2, err := http.Get(makeTestURL("http", "backend", "channels", ch))
+	require.Nil(t, err)
+	resp2.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp2.StatusCode)
+
+	resp3, err := http.Get(makeTestURL("http", testutil.RandStr(), "channels", APIPrefix))
+	require.Nil(t, err)
+	resp3.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp3.StatusCode)
+}